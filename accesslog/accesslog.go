@@ -0,0 +1,149 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/session"
+)
+
+type Format int
+
+const (
+	JSON Format = iota
+	Logfmt
+)
+
+// ParseFormat parses "json" or "logfmt".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "json":
+		return JSON, nil
+	case "logfmt":
+		return Logfmt, nil
+	default:
+		return 0, fmt.Errorf("unknown access log format -> (%s) <-", s)
+	}
+}
+
+// Logger writes one record per finished session.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+}
+
+func New(w io.Writer, format Format) *Logger {
+	return &Logger{w: w, format: format}
+}
+
+// field is a key of a record with its value, values are strings, ints or times.
+type field struct {
+	key   string
+	value interface{}
+}
+
+func fields(s *session.Session) []field {
+	fs := []field{
+		{"session", s.ID},
+		{"client", s.ClientAddr},
+		{"version", s.Version},
+		{"command", s.Command},
+		{"auth_method", s.AuthMethod},
+		{"user", s.User},
+		{"requested", s.RequestedDest},
+		{"resolved", s.ResolvedDest},
+	}
+	if s.ReplyCode >= 0 {
+		fs = append(fs, field{"reply", s.ReplyCode})
+	}
+	fs = append(fs,
+		field{"start", s.Start},
+		field{"end", s.End},
+		field{"duration_ms", s.End.Sub(s.Start).Milliseconds()},
+		field{"bytes_up", s.BytesUp},
+		field{"bytes_down", s.BytesDown},
+	)
+	if s.Err != nil {
+		fs = append(fs, field{"error", s.Err.Error()})
+	}
+	return fs
+}
+
+// Log writes the record of s, a nil Logger writes nothing.
+func (l *Logger) Log(s *session.Session) error {
+	if l == nil {
+		return nil
+	}
+	var line []byte
+	switch l.format {
+	case Logfmt:
+		line = appendLogfmt(nil, fields(s))
+	default:
+		line = appendJSON(nil, fields(s))
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// appendJSON writes the fields as a json object keeping their order.
+func appendJSON(b []byte, fs []field) []byte {
+	b = append(b, '{')
+	for i, f := range fs {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		key, _ := json.Marshal(f.key)
+		b = append(b, key...)
+		b = append(b, ':')
+		switch v := f.value.(type) {
+		case int, int64:
+			b = append(b, formatValue(v)...)
+		default:
+			value, _ := json.Marshal(formatValue(v))
+			b = append(b, value...)
+		}
+	}
+	return append(b, '}')
+}
+
+// appendLogfmt writes the fields as key=value pairs, values with spaces, quotes or '=' are quoted.
+func appendLogfmt(b []byte, fs []field) []byte {
+	for i, f := range fs {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, f.key...)
+		b = append(b, '=')
+		value := formatValue(f.value)
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			b = strconv.AppendQuote(b, value)
+		} else {
+			b = append(b, value...)
+		}
+	}
+	return b
+}
@@ -0,0 +1,209 @@
+package connlimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrLimitReached is wrapped by the errors of Acquire.
+var ErrLimitReached = errors.New("session limit reached")
+
+// Kind is what a session holds while it runs.
+type Kind byte
+
+const (
+	// TCP is a relayed TCP session (socks CONNECT or an HTTP proxy request).
+	TCP Kind = iota
+	// UDP is a UDP association.
+	UDP
+	// Bind is a BIND listener (and the session relayed through it).
+	Bind
+)
+
+func (k Kind) String() string {
+	switch k {
+	case TCP:
+		return "tcp"
+	case UDP:
+		return "udp"
+	case Bind:
+		return "bind"
+	default:
+		return strconv.Itoa(int(k))
+	}
+}
+
+// Caps are the maximum number of concurrent sessions of each kind, zero is unlimited.
+type Caps struct {
+	TCP  int
+	UDP  int
+	Bind int
+}
+
+func (c Caps) of(kind Kind) int {
+	switch kind {
+	case TCP:
+		return c.TCP
+	case UDP:
+		return c.UDP
+	default:
+		return c.Bind
+	}
+}
+
+type Config struct {
+	// MaxConns bounds the accepted connections (whatever their state is), the server stops accepting
+	// while it is reached so new clients wait in the listen backlog. zero is unlimited.
+	MaxConns int
+	// Global caps the sessions of the whole server, PerUser the ones of each authenticated user
+	// and PerIP the ones of each client IP.
+	Global  Caps
+	PerUser Caps
+	PerIP   Caps
+}
+
+// ParseConfig parses a comma separated list of key=value caps such as
+//
+//	conns=1000,tcp=500,udp=50,bind=10,user.tcp=20,user.udp=2,ip.tcp=50
+//
+// keys are conns (MaxConns), a kind (tcp, udp or bind) for the global caps
+// and user.<kind> or ip.<kind> for the per user and per client IP caps.
+func ParseConfig(s string) (Config, error) {
+	var c Config
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return Config{}, fmt.Errorf("expected 'key=value' -> (%s) <-", field)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid limit -> (%s) <-", field)
+		}
+		if key == "conns" {
+			c.MaxConns = n
+			continue
+		}
+		caps := &c.Global
+		scope, kind, scoped := strings.Cut(key, ".")
+		if scoped {
+			switch scope {
+			case "user":
+				caps = &c.PerUser
+			case "ip":
+				caps = &c.PerIP
+			default:
+				return Config{}, fmt.Errorf("unknown limit scope -> (%s) <-", scope)
+			}
+		} else {
+			kind = key
+		}
+		switch kind {
+		case "tcp":
+			caps.TCP = n
+		case "udp":
+			caps.UDP = n
+		case "bind":
+			caps.Bind = n
+		default:
+			return Config{}, fmt.Errorf("unknown limit -> (%s) <-", key)
+		}
+	}
+	return c, nil
+}
+
+type counterKey struct {
+	kind  Kind
+	scope string // "global", "user" or "ip"
+	name  string
+}
+
+// Limiter counts the running sessions, a nil Limiter limits nothing.
+type Limiter struct {
+	config Config
+	conns  chan struct{}
+
+	mu     sync.Mutex
+	counts map[counterKey]int
+}
+
+func New(config Config) *Limiter {
+	l := &Limiter{config: config, counts: make(map[counterKey]int)}
+	if config.MaxConns > 0 {
+		l.conns = make(chan struct{}, config.MaxConns)
+	}
+	return l
+}
+
+// AcquireConn waits for a connection slot (MaxConns), it returns false if done is closed first.
+func (l *Limiter) AcquireConn(done <-chan struct{}) bool {
+	if l == nil || l.conns == nil {
+		return true
+	}
+	select {
+	case l.conns <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// ReleaseConn frees the slot taken by AcquireConn.
+func (l *Limiter) ReleaseConn() {
+	if l == nil || l.conns == nil {
+		return
+	}
+	<-l.conns
+}
+
+// Acquire counts a session of kind for user (empty if unauthenticated) from clientIP,
+// the returned function must be called once the session is done. if a cap is reached nothing is counted
+// and the returned error wraps ErrLimitReached.
+func (l *Limiter) Acquire(kind Kind, user string, clientIP net.IP) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	keys := []counterKey{{kind: kind, scope: "global"}}
+	caps := []int{l.config.Global.of(kind)}
+	if user != "" {
+		keys = append(keys, counterKey{kind: kind, scope: "user", name: user})
+		caps = append(caps, l.config.PerUser.of(kind))
+	}
+	if clientIP != nil {
+		keys = append(keys, counterKey{kind: kind, scope: "ip", name: clientIP.String()})
+		caps = append(caps, l.config.PerIP.of(kind))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, key := range keys {
+		if caps[i] > 0 && l.counts[key] >= caps[i] {
+			if key.scope == "global" {
+				return nil, fmt.Errorf("%d concurrent %v sessions: %w", caps[i], kind, ErrLimitReached)
+			}
+			return nil, fmt.Errorf("%d concurrent %v sessions of %s (%s): %w", caps[i], kind, key.scope, key.name, ErrLimitReached)
+		}
+	}
+	for _, key := range keys {
+		l.counts[key]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, key := range keys {
+				if l.counts[key]--; l.counts[key] == 0 {
+					delete(l.counts, key)
+				}
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,131 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrBlocked is returned (wrapped) when a destination IP is blocked by the Guard.
+var ErrBlocked = errors.New("destination is blocked by the egress guard")
+
+// DefaultBlocked are the ranges a Guard blocks by default:
+// unspecified, loopback, private, shared (CGNAT), link-local (cloud metadata services), benchmarking, documentation,
+// discard-only, local-use NAT64, multicast and reserved addresses. IPv4-mapped IPv6 addresses and the addresses
+// of the well-known NAT64 prefix (64:ff9b::/96, they reach the IPv4 address they embed) are checked as IPv4.
+var DefaultBlocked = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// nat64Prefix is the well-known prefix of rfc 6052, its addresses end with the IPv4 address they are translated to.
+var nat64Prefix = mustParseCIDRs("64:ff9b::/96")[0]
+
+// Guard blocks destinations by IP, Allowed holds exceptions to Blocked.
+type Guard struct {
+	Blocked []*net.IPNet
+	Allowed []*net.IPNet
+}
+
+// NewGuard returns a Guard blocking DefaultBlocked except for allowed.
+func NewGuard(allowed ...*net.IPNet) *Guard {
+	return &Guard{Blocked: DefaultBlocked, Allowed: allowed}
+}
+
+// Check returns an error wrapping ErrBlocked if ip is blocked, a nil Guard blocks nothing.
+func (g *Guard) Check(ip net.IP) error {
+	if g == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if nat64Prefix.Contains(ip) {
+		ip = net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+	}
+	for _, n := range g.Allowed {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	for _, n := range g.Blocked {
+		if n.Contains(ip) {
+			return fmt.Errorf("%w (%v in %v)", ErrBlocked, ip, n)
+		}
+	}
+	return nil
+}
+
+// Control can be used as net.Dialer.Control (or net.ListenConfig.Control), it checks the address
+// the socket is about to connect to, that is the final IP after any name resolution.
+func (g *Guard) Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	return g.Check(net.ParseIP(host))
+}
+
+// WrapDial checks destinations given as IPs before calling dial, domain names are passed as is
+// (they are resolved by dial which should be guarded at its last hop).
+func (g *Guard) WrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if err := g.Check(ip); err != nil {
+				return nil, err
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// ParseCIDRs parses CIDRs or single IPs.
+func ParseCIDRs(values ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if _, n, err := net.ParseCIDR(v); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP or CIDR -> (%s) <-", v)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(values ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(values...)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
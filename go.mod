@@ -1,3 +1,5 @@
 module github.com/OmarTariq612/socks-server
 
 go 1.18
+
+require golang.org/x/crypto v0.8.0
@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Logger is the leveled, structured logger used by the server, args are alternating keys and values.
+// it is a subset of *slog.Logger (log/slog) so one can be used directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Level has the same values as slog.Level.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return strconv.Itoa(int(l))
+	}
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level -> (%s) <-", s)
+	}
+}
+
+// New returns a Logger writing records of level or above to l as "LEVEL msg key=value ...".
+func New(l *log.Logger, level Level) Logger {
+	return &stdLogger{l: l, level: level}
+}
+
+// Default writes info records and above through the standard logger.
+func Default() Logger {
+	return New(log.Default(), LevelInfo)
+}
+
+// Discard drops every record.
+func Discard() Logger {
+	return discard{}
+}
+
+// With returns a Logger adding args to every record of l.
+func With(l Logger, args ...any) Logger {
+	if w, ok := l.(*withLogger); ok {
+		return &withLogger{l: w.l, args: append(append([]any(nil), w.args...), args...)}
+	}
+	return &withLogger{l: l, args: args}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+func (s *stdLogger) Debug(msg string, args ...any) { s.log(LevelDebug, msg, args) }
+func (s *stdLogger) Info(msg string, args ...any)  { s.log(LevelInfo, msg, args) }
+func (s *stdLogger) Warn(msg string, args ...any)  { s.log(LevelWarn, msg, args) }
+func (s *stdLogger) Error(msg string, args ...any) { s.log(LevelError, msg, args) }
+
+func (s *stdLogger) log(level Level, msg string, args []any) {
+	if level < s.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(args) {
+			// a key without a value, slog reports it the same way
+			b.WriteString("!BADKEY=")
+			b.WriteString(formatValue(args[i]))
+			break
+		}
+		b.WriteString(fmt.Sprint(args[i]))
+		b.WriteByte('=')
+		b.WriteString(formatValue(args[i+1]))
+	}
+	s.l.Output(3, b.String())
+}
+
+func formatValue(v any) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+type withLogger struct {
+	l    Logger
+	args []any
+}
+
+func (w *withLogger) Debug(msg string, args ...any) { w.l.Debug(msg, w.with(args)...) }
+func (w *withLogger) Info(msg string, args ...any)  { w.l.Info(msg, w.with(args)...) }
+func (w *withLogger) Warn(msg string, args ...any)  { w.l.Warn(msg, w.with(args)...) }
+func (w *withLogger) Error(msg string, args ...any) { w.l.Error(msg, w.with(args)...) }
+
+func (w *withLogger) with(args []any) []any {
+	return append(append(make([]any, 0, len(w.args)+len(args)), w.args...), args...)
+}
+
+type discard struct{}
+
+func (discard) Debug(string, ...any) {}
+func (discard) Info(string, ...any)  {}
+func (discard) Warn(string, ...any)  {}
+func (discard) Error(string, ...any) {}
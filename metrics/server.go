@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+// protocol versions used as the version label.
+const (
+	VersionSocks4 = "4"
+	VersionSocks5 = "5"
+	VersionHTTP   = "http"
+)
+
+// Metrics holds the metrics of a SocksServer, a nil *Metrics records nothing.
+type Metrics struct {
+	registry *Registry
+
+	activeSessions *GaugeVec
+	handshakes     *CounterVec
+	authFailures   *CounterVec
+	dialDuration   *HistogramVec
+	dnsDuration    *HistogramVec
+	dnsErrors      *CounterVec
+	dnsCache       *CounterVec
+	relayedBytes   *CounterVec
+	udpRelayed     *CounterVec
+	udpDropped     *CounterVec
+}
+
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		registry:       r,
+		activeSessions: NewGaugeVec(r, "socks_server_active_sessions", "Sessions currently being served by protocol version and command.", "version", "command"),
+		handshakes:     NewCounterVec(r, "socks_server_handshakes_total", "Handshakes by protocol version, result (accepted or rejected) and rejection reason.", "version", "result", "reason"),
+		authFailures:   NewCounterVec(r, "socks_server_auth_failures_total", "Failed authentications by auth method.", "method"),
+		dialDuration:   NewHistogramVec(r, "socks_server_dial_duration_seconds", "Latency of outgoing dials by result.", DefaultLatencyBuckets, "result"),
+		dnsDuration:    NewHistogramVec(r, "socks_server_dns_duration_seconds", "Latency of dns resolutions by result.", DefaultLatencyBuckets, "result"),
+		dnsErrors:      NewCounterVec(r, "socks_server_dns_errors_total", "Failed dns resolutions by error kind.", "kind"),
+		dnsCache:       NewCounterVec(r, "socks_server_dns_cache_lookups_total", "Lookups of the dns cache by result (hit or miss).", "result"),
+		relayedBytes:   NewCounterVec(r, "socks_server_relayed_bytes_total", "Bytes relayed over TCP by protocol version and direction (up is client to server), counted when the relay ends.", "version", "direction"),
+		udpRelayed:     NewCounterVec(r, "socks_server_udp_datagrams_relayed_total", "UDP datagrams relayed by direction (up is client to destination).", "direction"),
+		udpDropped:     NewCounterVec(r, "socks_server_udp_datagrams_dropped_total", "UDP datagrams dropped by reason.", "reason"),
+	}
+}
+
+// Registry returns the registry holding the metrics so more can be added to the same endpoint.
+func (m *Metrics) Registry() *Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return m.registry.Handler()
+}
+
+// SessionStarted counts an active session until the returned function is called.
+func (m *Metrics) SessionStarted(version, command string) (done func()) {
+	if m == nil {
+		return func() {}
+	}
+	m.activeSessions.Inc(version, command)
+	return func() { m.activeSessions.Dec(version, command) }
+}
+
+func (m *Metrics) HandshakeAccepted(version string) {
+	if m == nil {
+		return
+	}
+	m.handshakes.Inc(version, "accepted", "")
+}
+
+func (m *Metrics) HandshakeRejected(version, reason string) {
+	if m == nil {
+		return
+	}
+	m.handshakes.Inc(version, "rejected", reason)
+}
+
+func (m *Metrics) AuthFailed(method string) {
+	if m == nil {
+		return
+	}
+	m.authFailures.Inc(method)
+}
+
+// ObserveDial records a dial that took d, result is "ok" or the kind of its error.
+func (m *Metrics) ObserveDial(d time.Duration, result string) {
+	if m == nil {
+		return
+	}
+	m.dialDuration.Observe(d.Seconds(), result)
+}
+
+// ObserveDNS records a resolution that took d, result is "ok" or the kind of its error (counted as a dns error).
+func (m *Metrics) ObserveDNS(d time.Duration, result string) {
+	if m == nil {
+		return
+	}
+	m.dnsDuration.Observe(d.Seconds(), result)
+	if result != "ok" {
+		m.dnsErrors.Inc(result)
+	}
+}
+
+// DNSCacheLookup counts a lookup of the dns cache, hit is false when it had to resolve the name.
+func (m *Metrics) DNSCacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.dnsCache.Inc("hit")
+	} else {
+		m.dnsCache.Inc("miss")
+	}
+}
+
+// AddRelayed adds the bytes of a finished relay.
+func (m *Metrics) AddRelayed(version string, up, down int64) {
+	if m == nil {
+		return
+	}
+	m.relayedBytes.Add(float64(up), version, "up")
+	m.relayedBytes.Add(float64(down), version, "down")
+}
+
+// UDPRelayed counts a datagram relayed in direction ("up" or "down").
+func (m *Metrics) UDPRelayed(direction string) {
+	if m == nil {
+		return
+	}
+	m.udpRelayed.Inc(direction)
+}
+
+func (m *Metrics) UDPDropped(reason string) {
+	if m == nil {
+		return
+	}
+	m.udpDropped.Inc(reason)
+}
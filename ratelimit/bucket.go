@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// minBurst keeps small rates usable with the chunks the relay reads and writes.
+const minBurst = 32 * 1024
+
+// Bucket is a token bucket of bytes refilled at a rate per second, a zero rate is unlimited.
+// a caller may take more tokens than available (the bucket goes into debt) and waits until the debt is paid.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket refilled at rate bytes per second (zero is unlimited).
+func NewBucket(rate int64) *Bucket {
+	b := &Bucket{}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the rate (zero is unlimited), it applies to the callers already waiting on their next call.
+func (b *Bucket) SetRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	wasUnlimited := b.rate == 0
+	b.refill(now)
+	b.rate = float64(rate)
+	b.burst = b.rate
+	if b.burst < minBurst {
+		b.burst = minBurst
+	}
+	if wasUnlimited || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Rate returns the rate in bytes per second (zero is unlimited).
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if b.rate == 0 {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long to wait until they are available.
+func (b *Bucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes n tokens only if they are available now.
+func (b *Bucket) allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// WaitN takes n tokens waiting until they are available or ctx is done.
+func (b *Bucket) WaitN(ctx context.Context, n int) error {
+	return waitAll(ctx, []*Bucket{b}, n)
+}
+
+// waitAll takes n tokens from every bucket and waits for the slowest one.
+func waitAll(ctx context.Context, buckets []*Bucket, n int) error {
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// allowAll takes n tokens from every bucket only if all of them have enough.
+// tokens taken from the first buckets are not given back when a later one has not enough,
+// which only makes the drop decision of the next datagrams slightly stricter.
+func allowAll(buckets []*Bucket, n int) bool {
+	for _, b := range buckets {
+		if !b.allow(n) {
+			return false
+		}
+	}
+	return true
+}
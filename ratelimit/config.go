@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/OmarTariq612/socks-server/egress"
+)
+
+// Rate is a pair of limits in bytes per second, zero is unlimited.
+// Up limits what clients send and Down what they receive.
+type Rate struct {
+	Up   int64
+	Down int64
+}
+
+// IPRate applies Rate to every client IP in Net (each IP has its own buckets).
+type IPRate struct {
+	Net  *net.IPNet
+	Rate Rate
+}
+
+// Config holds the limits of every scope, a session is limited by all the scopes it belongs to.
+type Config struct {
+	// Global is shared by every session.
+	Global Rate
+	// Users are shared by the sessions of the same authenticated user, DefaultUser applies to the users not in Users.
+	Users       map[string]Rate
+	DefaultUser Rate
+	// IPs are shared by the sessions of the same client IP, the first matching entry applies (DefaultIP if none does).
+	IPs       []IPRate
+	DefaultIP Rate
+	// Rules are shared by the sessions matching the rule with the same name (see rules.Rule.Name).
+	Rules map[string]Rate
+}
+
+func (c *Config) userRate(user string) Rate {
+	if rate, ok := c.Users[user]; ok {
+		return rate
+	}
+	return c.DefaultUser
+}
+
+func (c *Config) ipRate(ip net.IP) Rate {
+	for _, r := range c.IPs {
+		if r.Net.Contains(ip) {
+			return r.Rate
+		}
+	}
+	return c.DefaultIP
+}
+
+// Load reads a limits file, see Parse for the format.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return c, nil
+}
+
+// Parse reads limits, one per line:
+//
+//	# scope [target] up=RATE down=RATE
+//	global down=100M
+//	user alice up=1M down=10M
+//	user * down=5M
+//	ip 10.0.0.0/8 down=2M
+//	ip * down=20M
+//	rule bulk down=1M
+//
+// RATE is in bytes per second with an optional K, M or G suffix (powers of 1024), an omitted direction is unlimited.
+// '*' sets the limit of the users (or IPs) without a limit of their own.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{Users: make(map[string]Rate), Rules: make(map[string]Rate)}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := c.parseLine(strings.Fields(line)); err != nil {
+			return nil, fmt.Errorf("%d: %v", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) parseLine(fields []string) error {
+	scope := fields[0]
+	if scope == "global" {
+		rate, err := parseRateFields(fields[1:])
+		if err != nil {
+			return err
+		}
+		c.Global = rate
+		return nil
+	}
+	if len(fields) < 2 {
+		return fmt.Errorf("expected a target after -> (%s) <-", scope)
+	}
+	target := fields[1]
+	rate, err := parseRateFields(fields[2:])
+	if err != nil {
+		return err
+	}
+	switch scope {
+	case "user":
+		if target == "*" {
+			c.DefaultUser = rate
+		} else {
+			c.Users[target] = rate
+		}
+	case "ip":
+		if target == "*" {
+			c.DefaultIP = rate
+			return nil
+		}
+		nets, err := egress.ParseCIDRs(target)
+		if err != nil {
+			return err
+		}
+		c.IPs = append(c.IPs, IPRate{Net: nets[0], Rate: rate})
+	case "rule":
+		c.Rules[target] = rate
+	default:
+		return fmt.Errorf("unknown scope -> (%s) <-", scope)
+	}
+	return nil
+}
+
+func parseRateFields(fields []string) (Rate, error) {
+	var rate Rate
+	for _, field := range fields {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return Rate{}, fmt.Errorf("expected 'key=value' -> (%s) <-", field)
+		}
+		n, err := ParseBytes(value)
+		if err != nil {
+			return Rate{}, err
+		}
+		switch key {
+		case "up":
+			rate.Up = n
+		case "down":
+			rate.Down = n
+		default:
+			return Rate{}, fmt.Errorf("unknown key -> (%s) <-", key)
+		}
+	}
+	return rate, nil
+}
+
+// ParseBytes parses a number of bytes with an optional K, M or G suffix (powers of 1024).
+func ParseBytes(s string) (int64, error) {
+	multiplier := int64(1)
+	number := s
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+	}
+	if multiplier != 1 {
+		number = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number of bytes -> (%s) <-", s)
+	}
+	return n * multiplier, nil
+}
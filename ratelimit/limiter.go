@@ -0,0 +1,268 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// maxChunk bounds the bytes read or written at once through a limited connection so the traffic is smoothed.
+const maxChunk = 16 * 1024
+
+type scope byte
+
+const (
+	scopeGlobal scope = iota
+	scopeUser
+	scopeIP
+	scopeRule
+)
+
+type bucketKey struct {
+	scope scope
+	name  string
+}
+
+// buckets are the up and down buckets of one key, shared by the sessions holding a reference.
+type buckets struct {
+	up   *Bucket
+	down *Bucket
+	refs int
+}
+
+// Limiter hands out the buckets of every scope a session belongs to, the buckets of a user, IP or rule
+// are shared by their sessions and dropped when the last one is released.
+// Update changes the limits at runtime, the running sessions are affected without being interrupted.
+type Limiter struct {
+	mu      sync.Mutex
+	config  *Config
+	buckets map[bucketKey]*buckets
+}
+
+func New(config *Config) *Limiter {
+	if config == nil {
+		config = &Config{}
+	}
+	l := &Limiter{config: config, buckets: make(map[bucketKey]*buckets)}
+	rate := config.Global
+	l.buckets[bucketKey{scope: scopeGlobal}] = &buckets{up: NewBucket(rate.Up), down: NewBucket(rate.Down), refs: 1}
+	return l
+}
+
+// Update replaces the limits, including the ones of the buckets in use.
+func (l *Limiter) Update(config *Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+	for key, b := range l.buckets {
+		rate := l.rateLocked(key)
+		b.up.SetRate(rate.Up)
+		b.down.SetRate(rate.Down)
+	}
+}
+
+func (l *Limiter) rateLocked(key bucketKey) Rate {
+	switch key.scope {
+	case scopeUser:
+		return l.config.userRate(key.name)
+	case scopeIP:
+		return l.config.ipRate(net.ParseIP(key.name))
+	case scopeRule:
+		return l.config.Rules[key.name]
+	default:
+		return l.config.Global
+	}
+}
+
+func (l *Limiter) acquireLocked(key bucketKey) *buckets {
+	b, ok := l.buckets[key]
+	if !ok {
+		rate := l.rateLocked(key)
+		b = &buckets{up: NewBucket(rate.Up), down: NewBucket(rate.Down)}
+		l.buckets[key] = b
+	}
+	b.refs++
+	return b
+}
+
+func (l *Limiter) releaseLocked(key bucketKey) {
+	b, ok := l.buckets[key]
+	if !ok {
+		return
+	}
+	b.refs--
+	if b.refs == 0 && key.scope != scopeGlobal {
+		delete(l.buckets, key)
+	}
+}
+
+// Acquire returns the limits of a session of user (empty if unauthenticated) from clientIP whose request matched
+// the rule named rule (empty if none), the session must be released once done. a nil Limiter returns a nil (unlimited) Session.
+func (l *Limiter) Acquire(user string, clientIP net.IP, rule string) *Session {
+	if l == nil {
+		return nil
+	}
+	s := &Session{l: l}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.addLocked(bucketKey{scope: scopeGlobal})
+	if user != "" {
+		s.addLocked(bucketKey{scope: scopeUser, name: user})
+	}
+	if clientIP != nil {
+		s.addLocked(bucketKey{scope: scopeIP, name: clientIP.String()})
+	}
+	if rule != "" {
+		s.addLocked(bucketKey{scope: scopeRule, name: rule})
+	}
+	return s
+}
+
+// Session is the set of buckets limiting one session, a nil Session is unlimited.
+type Session struct {
+	l    *Limiter
+	keys []bucketKey
+	up   []*Bucket
+	down []*Bucket
+
+	// rules are the rule buckets acquired for the datagrams of a UDP association.
+	rulesMu sync.Mutex
+	rules   map[string]*buckets
+}
+
+func (s *Session) addLocked(key bucketKey) *buckets {
+	b := s.l.acquireLocked(key)
+	s.keys = append(s.keys, key)
+	s.up = append(s.up, b.up)
+	s.down = append(s.down, b.down)
+	return b
+}
+
+// Release returns the buckets of the session to the Limiter.
+func (s *Session) Release() {
+	if s == nil {
+		return
+	}
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	for _, key := range s.keys {
+		s.l.releaseLocked(key)
+	}
+	for name := range s.rules {
+		s.l.releaseLocked(bucketKey{scope: scopeRule, name: name})
+	}
+}
+
+// Conn wraps the client connection of the session, reads from it are limited by the up limits
+// and writes to it by the down limits. closing the returned connection interrupts a pending wait.
+func (s *Session) Conn(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return newLimitedConn(conn, s.up, s.down)
+}
+
+// ServerConn wraps the connection to the destination, it is the counterpart of Conn
+// for when the client side can not be wrapped (writes are limited by the up limits and reads by the down limits).
+func (s *Session) ServerConn(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return newLimitedConn(conn, s.down, s.up)
+}
+
+// AllowUp reports whether a datagram of n bytes sent by the client fits in the limits (the tokens are taken if it does),
+// rule is the name of the rule matching the datagram destination (empty if none).
+func (s *Session) AllowUp(n int, rule string) bool {
+	if s == nil {
+		return true
+	}
+	return allowAll(s.withRule(s.up, rule, true), n)
+}
+
+// AllowDown is AllowUp for a datagram sent to the client.
+func (s *Session) AllowDown(n int, rule string) bool {
+	if s == nil {
+		return true
+	}
+	return allowAll(s.withRule(s.down, rule, false), n)
+}
+
+// withRule appends the bucket of rule (acquired on first use) to buckets.
+func (s *Session) withRule(list []*Bucket, rule string, up bool) []*Bucket {
+	if rule == "" {
+		return list
+	}
+	s.rulesMu.Lock()
+	b, ok := s.rules[rule]
+	if !ok {
+		s.l.mu.Lock()
+		b = s.l.acquireLocked(bucketKey{scope: scopeRule, name: rule})
+		s.l.mu.Unlock()
+		if s.rules == nil {
+			s.rules = make(map[string]*buckets)
+		}
+		s.rules[rule] = b
+	}
+	s.rulesMu.Unlock()
+	bucket := b.down
+	if up {
+		bucket = b.up
+	}
+	return append(list[:len(list):len(list)], bucket)
+}
+
+type limitedConn struct {
+	net.Conn
+	read   []*Bucket
+	write  []*Bucket
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLimitedConn(conn net.Conn, read, write []*Bucket) *limitedConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &limitedConn{Conn: conn, read: read, write: write, ctx: ctx, cancel: cancel}
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if len(b) > maxChunk {
+		b = b[:maxChunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		// the bytes are already read, waiting delays the next read (an interrupted wait fails the next read instead)
+		waitAll(c.ctx, c.read, n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxChunk {
+			chunk = chunk[:maxChunk]
+		}
+		if err := waitAll(c.ctx, c.write, len(chunk)); err != nil {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *limitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection, utils.CloseWrite uses it to keep half-close working through the wrapper.
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+// Result describes a finished relay, up is the client to server direction and down the other one.
+type Result struct {
+	Up      int64
+	Down    int64
+	UpErr   error
+	DownErr error
+	// Idle is true if the connections were closed by the idle timeout.
+	Idle bool
+}
+
+// Err returns the first direction error (nil if both directions ended with EOF).
+func (r Result) Err() error {
+	if r.UpErr != nil {
+		return fmt.Errorf("could not copy from client to server, %v", r.UpErr)
+	}
+	if r.DownErr != nil {
+		return fmt.Errorf("could not copy from server to client, %v", r.DownErr)
+	}
+	return nil
+}
+
+// Relay copies data between client and server in both directions and returns once both are done.
+//
+// when a direction reaches EOF the write side of its destination is closed (half-close) so the peer
+// sees the EOF while the other direction keeps going, if a direction fails both connections are closed.
+// with a non zero idleTimeout both connections are closed after that long with no traffic in either direction.
+// the caller still owns (and closes) both connections.
+func Relay(client, server net.Conn, idleTimeout time.Duration) Result {
+	var result Result
+	var closeOnce sync.Once
+	var closed, idled int32
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			atomic.StoreInt32(&closed, 1)
+			client.Close()
+			server.Close()
+		})
+	}
+	idle := utils.NewIdleTimer(idleTimeout, func() {
+		atomic.StoreInt32(&idled, 1)
+		closeBoth()
+	})
+	defer idle.Stop()
+
+	// pipe copies src to dst then propagates the EOF to dst
+	pipe := func(dst net.Conn, src io.Reader) (int64, error) {
+		n, err := io.Copy(dst, idle.Reader(src))
+		if err != nil {
+			if atomic.LoadInt32(&closed) == 1 && errors.Is(err, net.ErrClosed) {
+				// closed by the other direction (or the idle timer), it is not an error of its own
+				return n, nil
+			}
+			closeBoth()
+			return n, err
+		}
+		if err := utils.CloseWrite(dst); err == nil {
+			return n, nil
+		}
+		// dst can not be half-closed, closing it ends the other direction as well
+		closeBoth()
+		return n, nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.Up, result.UpErr = pipe(server, client)
+	}()
+	go func() {
+		defer wg.Done()
+		result.Down, result.DownErr = pipe(client, server)
+	}()
+	wg.Wait()
+	result.Idle = atomic.LoadInt32(&idled) == 1
+	return result
+}
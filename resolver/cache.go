@@ -0,0 +1,247 @@
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/metrics"
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+// TTLResolver is a resolver that knows how long its answers are valid, a negative ttl means it is unknown.
+// the ttl of a not found error (a *net.DNSError with IsNotFound) is its negative caching TTL.
+type TTLResolver interface {
+	utils.Resolver
+	ResolveTTL(ctx context.Context, name string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// cache defaults.
+const (
+	DefaultCacheSize   = 4096
+	DefaultMinTTL      = 5 * time.Second
+	DefaultMaxTTL      = time.Hour
+	DefaultNegativeTTL = 30 * time.Second
+	DefaultTTL         = time.Minute
+)
+
+// CacheConfig configures a Cache, zero values use the defaults.
+type CacheConfig struct {
+	// Size is the most names kept, the least recently used one is evicted first.
+	Size int
+	// MinTTL and MaxTTL clamp how long an answer is kept, found or not.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long a name that was not found is kept when the resolver does not tell.
+	NegativeTTL time.Duration
+	// DefaultTTL is how long an answer is kept when the resolver does not tell (it is not a TTLResolver).
+	DefaultTTL time.Duration
+	// Metrics counts the hits and misses and records the latency and errors of the queries sent to the resolver (nil records nothing).
+	Metrics *metrics.Metrics
+}
+
+// CacheStats are the counters of a Cache.
+type CacheStats struct {
+	// Hits are the resolutions answered without querying the resolver, including the ones merged into a running query.
+	Hits uint64
+	// Misses are the queries sent to the resolver.
+	Misses  uint64
+	Entries int
+}
+
+// Cache is a Resolver keeping the answers of another one (addresses and not found errors) for their TTL,
+// concurrent resolutions of the same name are merged into a single query and other errors are never cached.
+type Cache struct {
+	hits   uint64 // atomic
+	misses uint64 // atomic
+
+	r      utils.Resolver
+	config CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, the most recently used first
+	calls   map[string]*call
+	// generation is incremented by Flush, the answers of the queries started before are not cached.
+	generation uint64
+}
+
+type cacheEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// call is a query in progress, done is closed once ips and err are set.
+type call struct {
+	done       chan struct{}
+	generation uint64
+	ips        []net.IP
+	err        error
+}
+
+func NewCache(r utils.Resolver, config CacheConfig) *Cache {
+	if config.Size <= 0 {
+		config.Size = DefaultCacheSize
+	}
+	if config.MinTTL <= 0 {
+		config.MinTTL = DefaultMinTTL
+	}
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = DefaultMaxTTL
+	}
+	if config.MaxTTL < config.MinTTL {
+		config.MaxTTL = config.MinTTL
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = DefaultNegativeTTL
+	}
+	if config.DefaultTTL <= 0 {
+		config.DefaultTTL = DefaultTTL
+	}
+	return &Cache{
+		r:       r,
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		calls:   make(map[string]*call),
+	}
+}
+
+func (c *Cache) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			entry := e.Value.(*cacheEntry)
+			if time.Now().Before(entry.expires) {
+				c.lru.MoveToFront(e)
+				c.mu.Unlock()
+				c.hit(true)
+				return entry.ips, entry.err
+			}
+			c.lru.Remove(e)
+			delete(c.entries, key)
+		}
+		cl, running := c.calls[key]
+		if !running {
+			cl = &call{done: make(chan struct{}), generation: c.generation}
+			c.calls[key] = cl
+			c.mu.Unlock()
+			c.hit(false)
+			c.query(ctx, key, name, cl)
+			return cl.ips, cl.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-cl.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// the query was made with the context of another caller, if it was cancelled try again with ours
+		if errors.Is(cl.err, context.Canceled) {
+			continue
+		}
+		c.hit(true)
+		return cl.ips, cl.err
+	}
+}
+
+// query resolves name, completes cl and caches its answer.
+func (c *Cache) query(ctx context.Context, key, name string, cl *call) {
+	start := time.Now()
+	ttl := time.Duration(-1)
+	if r, ok := c.r.(TTLResolver); ok {
+		cl.ips, ttl, cl.err = r.ResolveTTL(ctx, name)
+	} else {
+		cl.ips, cl.err = c.r.Resolve(ctx, name)
+	}
+	c.config.Metrics.ObserveDNS(time.Since(start), utils.ResultLabel(cl.err))
+
+	c.mu.Lock()
+	if c.calls[key] == cl {
+		delete(c.calls, key)
+	}
+	// the answer may predate a Flush (such as a reconfiguration of the resolver), it is returned but not cached
+	if ttl, ok := c.ttl(ttl, cl.err); ok && cl.generation == c.generation {
+		c.addLocked(&cacheEntry{name: key, ips: cl.ips, err: cl.err, expires: time.Now().Add(ttl)})
+	}
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+// ttl returns how long an answer is kept, ok is false if it should not be.
+func (c *Cache) ttl(ttl time.Duration, err error) (time.Duration, bool) {
+	switch {
+	case err == nil:
+		if ttl < 0 {
+			ttl = c.config.DefaultTTL
+		}
+	case isNotFound(err):
+		if ttl < 0 {
+			ttl = c.config.NegativeTTL
+		}
+	default:
+		return 0, false
+	}
+	if ttl < c.config.MinTTL {
+		ttl = c.config.MinTTL
+	}
+	if ttl > c.config.MaxTTL {
+		ttl = c.config.MaxTTL
+	}
+	return ttl, true
+}
+
+func (c *Cache) addLocked(entry *cacheEntry) {
+	if e, ok := c.entries[entry.name]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[entry.name] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).name)
+	}
+}
+
+func (c *Cache) hit(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	c.config.Metrics.DNSCacheLookup(hit)
+}
+
+// Flush forgets every cached answer, such as when the resolver it wraps is reconfigured,
+// the queries still running are not merged with the next lookups and their answers are not cached.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.calls = make(map[string]*call)
+	c.generation++
+	c.mu.Unlock()
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{Hits: atomic.LoadUint64(&c.hits), Misses: atomic.LoadUint64(&c.misses), Entries: entries}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,281 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+type fakeAnswer struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// fakeResolver answers from answers (any other name does not exist and has no negative TTL) and counts its queries,
+// if hold is set the first query waits until it is closed or its context is done.
+type fakeResolver struct {
+	answers map[string]fakeAnswer
+	hold    chan struct{}
+	queries int32 // atomic
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := r.ResolveTTL(ctx, name)
+	return ips, err
+}
+
+func (r *fakeResolver) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if atomic.AddInt32(&r.queries, 1) == 1 && r.hold != nil {
+		select {
+		case <-r.hold:
+		case <-ctx.Done():
+			return nil, -1, ctx.Err()
+		}
+	}
+	a, ok := r.answers[name]
+	if !ok {
+		return nil, -1, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return a.ips, a.ttl, a.err
+}
+
+func (r *fakeResolver) count() int32 {
+	return atomic.LoadInt32(&r.queries)
+}
+
+// plainResolver hides the ResolveTTL method of a fakeResolver.
+type plainResolver struct {
+	r *fakeResolver
+}
+
+func (p plainResolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	return p.r.Resolve(ctx, name)
+}
+
+// expiresIn returns how long the entry of name is kept (zero if there is none).
+func expiresIn(c *Cache, name string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return 0
+	}
+	return time.Until(e.Value.(*cacheEntry).expires)
+}
+
+func TestCacheTTL(t *testing.T) {
+	fake := &fakeResolver{answers: map[string]fakeAnswer{
+		"short.test":   {ips: []net.IP{testIPv4}, ttl: time.Second},
+		"long.test":    {ips: []net.IP{testIPv4}, ttl: 24 * time.Hour},
+		"fits.test":    {ips: []net.IP{testIPv4}, ttl: 30 * time.Second},
+		"unknown.test": {ips: []net.IP{testIPv4}, ttl: -1},
+	}}
+	config := CacheConfig{MinTTL: 10 * time.Second, MaxTTL: time.Minute, DefaultTTL: 20 * time.Second}
+	tests := []struct {
+		name string
+		r    utils.Resolver
+		want time.Duration
+	}{
+		{"short.test", fake, config.MinTTL},
+		{"long.test", fake, config.MaxTTL},
+		{"fits.test", fake, 30 * time.Second},
+		{"unknown.test", fake, config.DefaultTTL},
+		// a resolver that does not know the TTLs
+		{"long.test", plainResolver{fake}, config.DefaultTTL},
+	}
+	for _, test := range tests {
+		cache := NewCache(test.r, config)
+		ips, err := cache.Resolve(context.Background(), test.name)
+		if err != nil {
+			t.Fatalf("Resolve(%q) error = %v", test.name, err)
+		}
+		if !equalIPs(ips, []net.IP{testIPv4}) {
+			t.Errorf("Resolve(%q) = %v, want %v", test.name, ips, testIPv4)
+		}
+		if ttl := expiresIn(cache, test.name); ttl <= test.want-time.Second || ttl > test.want {
+			t.Errorf("%q expires in %v, want %v", test.name, ttl, test.want)
+		}
+	}
+}
+
+func TestCacheNotFound(t *testing.T) {
+	fake := &fakeResolver{answers: map[string]fakeAnswer{
+		"servfail.test": {ttl: -1, err: &net.DNSError{Err: "server misbehaving", Name: "servfail.test"}},
+	}}
+	cache := NewCache(fake, CacheConfig{NegativeTTL: 20 * time.Second})
+	for i := 0; i < 2; i++ {
+		_, err := cache.Resolve(context.Background(), "Missing.Test.")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("Resolve() #%d error = %v, want not found", i, err)
+		}
+	}
+	if queries := fake.count(); queries != 1 {
+		t.Errorf("resolver got %d queries, want 1", queries)
+	}
+	if ttl := expiresIn(cache, "missing.test"); ttl <= 19*time.Second || ttl > 20*time.Second {
+		t.Errorf("negative entry expires in %v, want the NegativeTTL", ttl)
+	}
+
+	// other errors are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Resolve(context.Background(), "servfail.test"); err == nil {
+			t.Fatalf("Resolve() #%d succeeded, want an error", i)
+		}
+	}
+	if queries := fake.count(); queries != 3 {
+		t.Errorf("resolver got %d queries, want 3", queries)
+	}
+}
+
+func TestCacheMergesConcurrentLookups(t *testing.T) {
+	fake := &fakeResolver{
+		answers: map[string]fakeAnswer{"a.test": {ips: []net.IP{testIPv4}, ttl: time.Minute}},
+		hold:    make(chan struct{}),
+	}
+	cache := NewCache(fake, CacheConfig{})
+	const callers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := cache.Resolve(context.Background(), "a.test")
+			if err == nil && !equalIPs(ips, []net.IP{testIPv4}) {
+				err = errors.New("wrong addresses")
+			}
+			errs <- err
+		}()
+	}
+	// let every caller reach the running query
+	time.Sleep(50 * time.Millisecond)
+	close(fake.hold)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Resolve() error = %v", err)
+		}
+	}
+	if queries := fake.count(); queries != 1 {
+		t.Errorf("resolver got %d queries, want 1", queries)
+	}
+	if stats := cache.Stats(); stats.Hits != callers-1 || stats.Misses != 1 {
+		t.Errorf("Stats() = %+v, want %d hits and 1 miss", stats, callers-1)
+	}
+}
+
+func TestCacheRetriesCancelledQuery(t *testing.T) {
+	fake := &fakeResolver{
+		answers: map[string]fakeAnswer{"a.test": {ips: []net.IP{testIPv4}, ttl: time.Minute}},
+		hold:    make(chan struct{}),
+	}
+	cache := NewCache(fake, CacheConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := cache.Resolve(ctx, "a.test")
+		leader <- err
+	}()
+	// the leader is holding the query before the follower joins it
+	for fake.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	follower := make(chan error, 1)
+	go func() {
+		ips, err := cache.Resolve(context.Background(), "a.test")
+		if err == nil && !equalIPs(ips, []net.IP{testIPv4}) {
+			err = errors.New("wrong addresses")
+		}
+		follower <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader Resolve() error = %v, want %v", err, context.Canceled)
+	}
+	if err := <-follower; err != nil {
+		t.Errorf("follower Resolve() error = %v, want the query to be sent again with its context", err)
+	}
+	if queries := fake.count(); queries != 2 {
+		t.Errorf("resolver got %d queries, want 2", queries)
+	}
+	if _, err := cache.Resolve(context.Background(), "a.test"); err != nil || fake.count() != 2 {
+		t.Errorf("the answer of the second query is not cached (error = %v)", err)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	fake := &fakeResolver{answers: map[string]fakeAnswer{
+		"a.test": {ips: []net.IP{testIPv4}, ttl: time.Minute},
+		"b.test": {ips: []net.IP{testIPv4}, ttl: time.Minute},
+		"c.test": {ips: []net.IP{testIPv4}, ttl: time.Minute},
+	}}
+	cache := NewCache(fake, CacheConfig{Size: 2})
+	// a is used again after b, so b is the least recently used name once c is added
+	for _, name := range []string{"a.test", "b.test", "a.test", "c.test"} {
+		if _, err := cache.Resolve(context.Background(), name); err != nil {
+			t.Fatalf("Resolve(%q) error = %v", name, err)
+		}
+	}
+	if queries := fake.count(); queries != 3 {
+		t.Errorf("resolver got %d queries, want 3", queries)
+	}
+	if entries := cache.Stats().Entries; entries != 2 {
+		t.Errorf("cache has %d entries, want 2", entries)
+	}
+	for _, test := range []struct {
+		name   string
+		cached bool
+	}{{"a.test", true}, {"c.test", true}, {"b.test", false}} {
+		if cached := expiresIn(cache, test.name) > 0; cached != test.cached {
+			t.Errorf("%q cached = %v, want %v", test.name, cached, test.cached)
+		}
+	}
+}
+
+func TestCacheFlushDropsRunningQuery(t *testing.T) {
+	fake := &fakeResolver{
+		answers: map[string]fakeAnswer{"a.test": {ips: []net.IP{testIPv4}, ttl: time.Minute}},
+		hold:    make(chan struct{}),
+	}
+	cache := NewCache(fake, CacheConfig{})
+	leader := make(chan error, 1)
+	go func() {
+		_, err := cache.Resolve(context.Background(), "a.test")
+		leader <- err
+	}()
+	for fake.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Flush()
+
+	// a lookup after the flush sends its own query instead of waiting for the running one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := cache.Resolve(ctx, "a.test"); err != nil {
+		t.Fatalf("Resolve() after Flush error = %v", err)
+	}
+	if queries := fake.count(); queries != 2 {
+		t.Errorf("resolver got %d queries, want 2", queries)
+	}
+
+	cache.Flush()
+	close(fake.hold)
+	if err := <-leader; err != nil {
+		t.Fatalf("leader Resolve() error = %v", err)
+	}
+	if expiresIn(cache, "a.test") > 0 {
+		t.Error("the answer of a query started before Flush is cached")
+	}
+}
@@ -0,0 +1,246 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+// queryTimeout bounds a resolution whose context has no deadline.
+const queryTimeout = 5 * time.Second
+
+// exchanger sends a query message to a DNS server and returns its response.
+type exchanger interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// DNS resolves names by asking a DNS server for their AAAA and A records (the IPv6 addresses come first, as rfc 8305 prefers),
+// it is a TTLResolver so a Cache keeps its answers as long as the server allows.
+type DNS struct {
+	server string
+	ex     exchanger
+}
+
+// NewDNS returns a resolver querying the DNS server at addr (ip:port) over UDP, truncated responses are retried over TCP.
+func NewDNS(addr string) *DNS {
+	return &DNS{server: addr, ex: &plainExchanger{addr: addr}}
+}
+
+// FromURL returns a resolver querying server, dohMethod (GET or POST) and tlsConfig only apply to the encrypted protocols.
+//
+// supported formats:
+//   - ip:port (or udp://ip:port) plain DNS
+//   - tls://host[:port] DNS over TLS (port 853 by default)
+//   - https://host[:port]/path DNS over HTTPS
+func FromURL(server string, dohMethod string, tlsConfig *tls.Config) (*DNS, error) {
+	scheme, rest, ok := strings.Cut(server, "://")
+	if !ok {
+		scheme, rest = "udp", server
+	}
+	switch strings.ToLower(scheme) {
+	case "udp":
+		host, _, err := net.SplitHostPort(rest)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid dns server -> (%s) <-, expected ip:port", server)
+		}
+		return NewDNS(rest), nil
+	case "tls":
+		addr := strings.TrimSuffix(rest, "/")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "853")
+		}
+		return NewDoT(addr, tlsConfig)
+	case "https":
+		return NewDoH(server, dohMethod, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported dns server scheme -> (%s) <-", scheme)
+	}
+}
+
+func (d *DNS) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := d.ResolveTTL(ctx, name)
+	return ips, err
+}
+
+// ResolveTTL queries the AAAA and A records of name concurrently and returns their addresses (IPv6 first)
+// and the TTL of the answer, a name without addresses is reported as not found along with its negative caching TTL (-1 if unknown).
+func (d *DNS) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+	}
+
+	qtypes := [2]uint16{typeAAAA, typeA}
+	var answers [2]*answer
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i := range qtypes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			answers[i], errs[i] = d.query(ctx, name, qtypes[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	ttl := int64(-1)
+	for i, ans := range answers {
+		if errs[i] == nil && len(ans.ips) > 0 {
+			ips = append(ips, ans.ips...)
+			if ttl < 0 || ans.ttl < ttl {
+				ttl = ans.ttl
+			}
+		}
+	}
+	if len(ips) > 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, -1, d.error(ctx, name, err)
+		}
+	}
+
+	// NXDOMAIN or no address of either type
+	for _, ans := range answers {
+		if ans.ttl >= 0 && (ttl < 0 || ans.ttl < ttl) {
+			ttl = ans.ttl
+		}
+	}
+	negativeTTL := time.Duration(-1)
+	if ttl >= 0 {
+		negativeTTL = time.Duration(ttl) * time.Second
+	}
+	return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: name, Server: d.server, IsNotFound: true}
+}
+
+// query sends a query of qtype for name, any response code other than NOERROR and NXDOMAIN is an error.
+func (d *DNS) query(ctx context.Context, name string, qtype uint16) (*answer, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query, err := newQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	response, err := d.ex.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	ans, err := parseResponse(response, query)
+	if err != nil {
+		return nil, err
+	}
+	if ans.rcode != rcodeSuccess && ans.rcode != rcodeNameError {
+		return nil, fmt.Errorf("dns server replied with rcode -> (%d) <-", ans.rcode)
+	}
+	return ans, nil
+}
+
+// error reports a failed query as a *net.DNSError (as the standard resolver does) unless ctx was cancelled.
+func (d *DNS) error(ctx context.Context, name string, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	dnsErr := &net.DNSError{Err: err.Error(), Name: name, Server: d.server, IsTemporary: true}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) || ctx.Err() != nil {
+		dnsErr.Err = "i/o timeout"
+		dnsErr.IsTimeout = true
+	}
+	return dnsErr
+}
+
+// plainExchanger talks to a DNS server over UDP, falling back to TCP for truncated responses (rfc 7766).
+type plainExchanger struct {
+	addr string
+}
+
+func (e *plainExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	response, err := e.exchangeUDP(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) >= headerLen && binary.BigEndian.Uint16(response[2:])&flagTruncated != 0 {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", e.addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return exchangeStream(ctx, conn, query)
+	}
+	return response, nil
+}
+
+func (e *plainExchanger) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := utils.CloseOnDone(ctx, conn)
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		// datagrams that do not answer this query (late responses to another one or spoofed ones) are ignored
+		if n >= headerLen && buf[0] == query[0] && buf[1] == query[1] && equalQuestion(buf[headerLen:n], query[headerLen:]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends query over a stream connection (TCP or TLS) where messages are prefixed by their length.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	stop := utils.CloseOnDone(ctx, conn)
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
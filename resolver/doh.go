@@ -0,0 +1,106 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	maxMessageLen  = 65535
+)
+
+// NewDoH returns a resolver querying the DNS over HTTPS server at rawURL (such as https://host/dns-query) as rfc 8484 describes,
+// method is either GET or POST. tlsConfig (nil uses the system roots) sets the CA certificates trusted and the SNI sent.
+func NewDoH(rawURL string, method string, tlsConfig *tls.Config) (*DNS, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns over https url -> (%s) <-: %v", rawURL, err)
+	}
+	if !strings.EqualFold(u.Scheme, "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid dns over https url -> (%s) <-, expected https://host[:port]/path", rawURL)
+	}
+	method = strings.ToUpper(method)
+	if method != http.MethodGet && method != http.MethodPost {
+		return nil, fmt.Errorf("invalid dns over https method -> (%s) <-, expected 'GET' or 'POST'", method)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	transport := &http.Transport{
+		// the server is reached directly whatever the environment says about proxies
+		Proxy:               nil,
+		TLSClientConfig:     tlsConfig.Clone(),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: queryTimeout,
+	}
+	ex := &dohExchanger{url: u, method: method, client: &http.Client{Transport: transport}}
+	return &DNS{server: rawURL, ex: ex}, nil
+}
+
+// dohExchanger sends queries as HTTP requests, their ID is 0 so the responses of GET requests can be cached by the server (rfc 8484 section 4.1).
+type dohExchanger struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func (e *dohExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	msg := make([]byte, len(query))
+	copy(msg, query)
+	msg[0], msg[1] = 0, 0
+
+	var req *http.Request
+	var err error
+	if e.method == http.MethodGet {
+		u := *e.url
+		values := u.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(msg))
+		u.RawQuery = values.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, e.url.String(), bytes.NewReader(msg))
+		if err == nil {
+			req.Header.Set("Content-Type", dohContentType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns over https server replied with status -> (%s) <-", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, dohContentType) {
+		return nil, fmt.Errorf("dns over https server replied with content type -> (%s) <-", contentType)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) > maxMessageLen {
+		return nil, fmt.Errorf("dns over https response is too long")
+	}
+	if len(response) < headerLen {
+		return nil, errShortMessage
+	}
+	// give the response the ID of the query again, HTTP already matched them
+	response[0], response[1] = query[0], query[1]
+	return response, nil
+}
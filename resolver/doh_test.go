@@ -0,0 +1,226 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the records of the stand-in servers.
+var (
+	testIPv4 = net.IP{192, 0, 2, 1}
+	testIPv6 = net.ParseIP("2001:db8::1")
+)
+
+const testNegativeTTL = 7
+
+// answerQuery answers query as a DNS server would: a.test has an A and an AAAA record, any other name does not exist.
+func answerQuery(t *testing.T, query []byte) []byte {
+	t.Helper()
+	if len(query) < headerLen+5 {
+		t.Errorf("query is too short -> (%x) <-", query)
+		return nil
+	}
+	var labels []string
+	off := headerLen
+	for off < len(query) && query[off] != 0 {
+		length := int(query[off])
+		labels = append(labels, string(query[off+1:off+1+length]))
+		off += 1 + length
+	}
+	qtype := binary.BigEndian.Uint16(query[off+1:])
+
+	name := pointer(headerLen)
+	if strings.Join(labels, ".") != "a.test" {
+		return buildResponse(query, rcodeNameError, nil, []testRecord{
+			{name: wireName(t, "test"), typ: typeSOA, ttl: 3600, data: soaData(t, testNegativeTTL)},
+		})
+	}
+	if qtype == typeA {
+		return buildResponse(query, rcodeSuccess, []testRecord{{name: name, typ: typeA, ttl: 60, data: testIPv4.To4()}}, nil)
+	}
+	return buildResponse(query, rcodeSuccess, []testRecord{{name: name, typ: typeAAAA, ttl: 60, data: testIPv6}}, nil)
+}
+
+// newTestServer starts a DNS over HTTPS stand-in serving handler and returns it along with a client TLS configuration
+// trusting its certificate (loaded from a CA file) and sending the name the certificate is issued for.
+func newTestServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *tls.Config) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	// handshakes failing on purpose are not logged
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := TLSConfig(caFile, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, tlsConfig
+}
+
+func dohHandler(t *testing.T, method string, queries *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			t.Errorf("method = %s, want %s", r.Method, method)
+		}
+		if r.TLS == nil || r.TLS.ServerName != "example.com" {
+			t.Errorf("request is not sent over TLS with the configured SNI")
+		}
+		if accept := r.Header.Get("Accept"); accept != dohContentType {
+			t.Errorf("Accept = %q, want %q", accept, dohContentType)
+		}
+		var query []byte
+		var err error
+		if r.Method == http.MethodGet {
+			if r.URL.Query().Get("keep") != "1" {
+				t.Errorf("the query of the url is lost -> (%s) <-", r.URL)
+			}
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			if contentType := r.Header.Get("Content-Type"); contentType != dohContentType {
+				t.Errorf("Content-Type = %q, want %q", contentType, dohContentType)
+			}
+			query, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			t.Errorf("could not read the query: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(query) < 2 || query[0] != 0 || query[1] != 0 {
+			t.Errorf("query ID is not 0 -> (%x) <-", query)
+		}
+		atomic.AddInt32(queries, 1)
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(answerQuery(t, query))
+	}
+}
+
+func TestDoH(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			var queries int32
+			srv, tlsConfig := newTestServer(t, dohHandler(t, method, &queries))
+			dns, err := NewDoH(srv.URL+"/dns-query?keep=1", strings.ToLower(method), tlsConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ips, ttl, err := dns.ResolveTTL(context.Background(), "a.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []net.IP{testIPv6, testIPv4}; !equalIPs(ips, want) {
+				t.Errorf("ResolveTTL() = %v, want %v", ips, want)
+			}
+			if ttl != time.Minute {
+				t.Errorf("ResolveTTL() ttl = %v, want %v", ttl, time.Minute)
+			}
+			if queries := atomic.LoadInt32(&queries); queries != 2 {
+				t.Errorf("server got %d queries, want 2", queries)
+			}
+		})
+	}
+}
+
+func TestDoHErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "content type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				query, _ := io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(answerQuery(t, query))
+			},
+		},
+		{
+			name: "short response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", dohContentType)
+				w.Write([]byte{0, 0, 0x81})
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, tlsConfig := newTestServer(t, test.handler)
+			dns, err := NewDoH(srv.URL+"/dns-query", http.MethodPost, tlsConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = dns.Resolve(context.Background(), "a.test")
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+				t.Errorf("Resolve() error = %v, want a failed lookup", err)
+			}
+		})
+	}
+}
+
+func TestDoHUntrustedServer(t *testing.T) {
+	var queries int32
+	srv, _ := newTestServer(t, dohHandler(t, http.MethodPost, &queries))
+	// the system roots do not trust the certificate of the test server
+	dns, err := NewDoH(srv.URL+"/dns-query", http.MethodPost, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dns.Resolve(context.Background(), "a.test"); err == nil {
+		t.Error("Resolve() succeeded with an untrusted certificate")
+	}
+	if queries := atomic.LoadInt32(&queries); queries != 0 {
+		t.Errorf("server got %d queries, want 0", queries)
+	}
+}
+
+func TestNewDoHInvalid(t *testing.T) {
+	for _, test := range []struct{ url, method string }{
+		{"http://127.0.0.1/dns-query", http.MethodPost},
+		{"https:///dns-query", http.MethodPost},
+		{"https://127.0.0.1/dns-query", http.MethodPut},
+	} {
+		if _, err := NewDoH(test.url, test.method, nil); err == nil {
+			t.Errorf("NewDoH(%q, %q) succeeded, want an error", test.url, test.method)
+		}
+	}
+}
+
+func equalIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
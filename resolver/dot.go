@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxIdleDoTConns is how many connections to a DNS over TLS server are kept open for the next queries.
+const maxIdleDoTConns = 2
+
+// NewDoT returns a resolver querying the DNS over TLS server at addr (host:port) as rfc 7858 describes,
+// tlsConfig (nil uses the system roots) sets the CA certificates trusted and the SNI sent (the host of addr by default).
+func NewDoT(addr string, tlsConfig *tls.Config) (*DNS, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns over tls server -> (%s) <-, expected host:port", addr)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" && net.ParseIP(host) == nil {
+		tlsConfig.ServerName = host
+	}
+	ex := &dotExchanger{dialer: &tls.Dialer{Config: tlsConfig}, addr: addr}
+	return &DNS{server: addr, ex: ex}, nil
+}
+
+// dotExchanger sends one query at a time on each TLS connection, connections are reused (rfc 7858 section 3.4).
+type dotExchanger struct {
+	dialer *tls.Dialer
+	addr   string
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+func (e *dotExchanger) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	for {
+		conn, reused := e.get()
+		if conn == nil {
+			var err error
+			if conn, err = e.dialer.DialContext(ctx, "tcp", e.addr); err != nil {
+				return nil, err
+			}
+		}
+		response, err := exchangeStream(ctx, conn, query)
+		if err != nil {
+			conn.Close()
+			// the server may have closed an idle connection, try again on a new one
+			if reused && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		e.put(conn)
+		return response, nil
+	}
+}
+
+func (e *dotExchanger) get() (net.Conn, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.idle) == 0 {
+		return nil, false
+	}
+	conn := e.idle[len(e.idle)-1]
+	e.idle = e.idle[:len(e.idle)-1]
+	return conn, true
+}
+
+func (e *dotExchanger) put(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.idle) >= maxIdleDoTConns {
+		conn.Close()
+		return
+	}
+	e.idle = append(e.idle, conn)
+}
+
+// TLSConfig returns the TLS configuration of DNS over HTTPS and DNS over TLS resolvers,
+// caFile (PEM) replaces the system roots and serverName replaces the SNI sent and the name verified in the certificate of the server.
+func TLSConfig(caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the CA file -> (%s) <-", caFile)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,207 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dotServer is a DNS over TLS stand-in, it closes every connection after answering closeAfter queries (0 keeps them open).
+type dotServer struct {
+	addr       string
+	tlsConfig  *tls.Config // of the clients
+	closeAfter int
+
+	conns   int32 // atomic
+	queries int32 // atomic
+}
+
+func newDoTServer(t *testing.T, closeAfter int) *dotServer {
+	t.Helper()
+	// the certificate of the DNS over HTTPS stand-in is reused, along with the client configuration trusting it
+	https, tlsConfig := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: https.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dotServer{addr: ln.Addr().String(), tlsConfig: tlsConfig, closeAfter: closeAfter}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(t, conn)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *dotServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for answered := 0; s.closeAfter == 0 || answered < s.closeAfter; answered++ {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		atomic.AddInt32(&s.queries, 1)
+		response := answerQuery(t, query)
+		msg := make([]byte, 2+len(response))
+		binary.BigEndian.PutUint16(msg, uint16(len(response)))
+		copy(msg[2:], response)
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func TestDoT(t *testing.T) {
+	srv := newDoTServer(t, 0)
+	dns, err := NewDoT(srv.addr, srv.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ips, ttl, err := dns.ResolveTTL(context.Background(), "a.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []net.IP{testIPv6, testIPv4}; !equalIPs(ips, want) {
+			t.Errorf("ResolveTTL() = %v, want %v", ips, want)
+		}
+		if ttl != time.Minute {
+			t.Errorf("ResolveTTL() ttl = %v, want %v", ttl, time.Minute)
+		}
+	}
+	if queries := atomic.LoadInt32(&srv.queries); queries != 6 {
+		t.Errorf("server got %d queries, want 6", queries)
+	}
+	// the A and AAAA queries run concurrently, the connections they open are reused afterwards
+	if conns := atomic.LoadInt32(&srv.conns); conns > maxIdleDoTConns {
+		t.Errorf("server got %d connections, want at most %d", conns, maxIdleDoTConns)
+	}
+}
+
+func TestDoTServerClosesConnections(t *testing.T) {
+	srv := newDoTServer(t, 1)
+	dns, err := NewDoT(srv.addr, srv.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := dns.Resolve(context.Background(), "a.test"); err != nil {
+			t.Fatalf("Resolve() #%d error = %v", i, err)
+		}
+		// let the server close the connections kept idle
+		time.Sleep(50 * time.Millisecond)
+	}
+	if queries := atomic.LoadInt32(&srv.queries); queries != 6 {
+		t.Errorf("server got %d queries, want 6", queries)
+	}
+	if conns := atomic.LoadInt32(&srv.conns); conns != 6 {
+		t.Errorf("server got %d connections, want 6", conns)
+	}
+}
+
+func TestDoTServerName(t *testing.T) {
+	srv := newDoTServer(t, 0)
+	tlsConfig := srv.tlsConfig.Clone()
+	tlsConfig.ServerName = "dns.example.org"
+	dns, err := NewDoT(srv.addr, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dns.Resolve(context.Background(), "a.test"); err == nil {
+		t.Error("Resolve() succeeded with a certificate issued for another name")
+	}
+	if queries := atomic.LoadInt32(&srv.queries); queries != 0 {
+		t.Errorf("server got %d queries, want 0", queries)
+	}
+}
+
+func TestDoTNotFoundCached(t *testing.T) {
+	srv := newDoTServer(t, 0)
+	dns, err := NewDoT(srv.addr, srv.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCache(dns, CacheConfig{})
+	for i := 0; i < 2; i++ {
+		_, err := cache.Resolve(context.Background(), "missing.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("Resolve() #%d error = %v, want not found", i, err)
+		}
+	}
+	if queries := atomic.LoadInt32(&srv.queries); queries != 2 {
+		t.Errorf("server got %d queries, want 2 (A and AAAA once)", queries)
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Stats() = %+v, want 1 hit, 1 miss and 1 entry", stats)
+	}
+
+	// the negative entry lives for the SOA minimum of the answer
+	cache.mu.Lock()
+	expires := cache.entries["missing.test"].Value.(*cacheEntry).expires
+	cache.mu.Unlock()
+	if ttl := time.Until(expires); ttl <= (testNegativeTTL-1)*time.Second || ttl > testNegativeTTL*time.Second {
+		t.Errorf("negative entry expires in %v, want %ds", ttl, testNegativeTTL)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	if _, err := TLSConfig("/nonexistent/ca.pem", ""); err == nil {
+		t.Error("TLSConfig() of a missing file succeeded")
+	}
+	empty := t.TempDir() + "/empty.pem"
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TLSConfig(empty, ""); err == nil {
+		t.Error("TLSConfig() of a file without certificates succeeded")
+	}
+	config, err := TLSConfig("", "dns.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs != nil || config.ServerName != "dns.example.com" {
+		t.Errorf("TLSConfig() = %+v, want the system roots and the given server name", config)
+	}
+}
@@ -0,0 +1,228 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+)
+
+// record types and class (rfc 1035 section 3.2).
+const (
+	typeA     uint16 = 1
+	typeCNAME uint16 = 5
+	typeSOA   uint16 = 6
+	typeAAAA  uint16 = 28
+	classINET uint16 = 1
+)
+
+// response codes (rfc 1035 section 4.1.1).
+const (
+	rcodeSuccess   = 0
+	rcodeNameError = 3 // NXDOMAIN
+)
+
+// header flags.
+const (
+	flagResponse         uint16 = 1 << 15
+	flagTruncated        uint16 = 1 << 9
+	flagRecursionDesired uint16 = 1 << 8
+)
+
+const headerLen = 12
+
+var errShortMessage = errors.New("dns message is too short")
+
+// +------+-------+---------+---------+---------+---------+----------+
+// |  ID  | FLAGS | QDCOUNT | ANCOUNT | NSCOUNT | ARCOUNT | QUESTION |
+// +------+-------+---------+---------+---------+---------+----------+
+// |  2   |   2   |    2    |    2    |    2    |    2    | Variable |
+// +------+-------+---------+---------+---------+---------+----------+
+func newQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	b := make([]byte, headerLen, headerLen+len(name)+6)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flagRecursionDesired)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b, err := appendName(b, name)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, byte(qtype>>8), byte(qtype), byte(classINET>>8), byte(classINET)), nil
+}
+
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return nil, fmt.Errorf("invalid domain name -> (%s) <-", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain name -> (%s) <-", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// answer is what a response tells about the queried name.
+type answer struct {
+	rcode int
+	ips   []net.IP
+	// ttl is the smallest TTL of the answer records or, for a response without addresses,
+	// the negative caching TTL taken from the SOA record of the authority section (rfc 2308), -1 if there is none.
+	ttl int64
+}
+
+// parseResponse parses the response to query (made by newQuery), the response must echo its ID and question.
+func parseResponse(b []byte, query []byte) (*answer, error) {
+	if len(b) < headerLen {
+		return nil, errShortMessage
+	}
+	if b[0] != query[0] || b[1] != query[1] {
+		return nil, fmt.Errorf("dns response id mismatch")
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	if flags&flagResponse == 0 {
+		return nil, fmt.Errorf("dns message is not a response")
+	}
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	anCount := int(binary.BigEndian.Uint16(b[6:]))
+	nsCount := int(binary.BigEndian.Uint16(b[8:]))
+
+	// a spoofed response has to guess the question as well as the ID
+	question := query[headerLen:]
+	if qdCount != 1 || !equalQuestion(b[headerLen:], question) {
+		return nil, fmt.Errorf("dns response question mismatch")
+	}
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+	off := headerLen + len(question)
+	var err error
+
+	ans := &answer{rcode: int(flags & 0xf), ttl: -1}
+	minTTL := int64(math.MaxUint32)
+	for i := 0; i < anCount; i++ {
+		var rr record
+		if rr, off, err = readRecord(b, off); err != nil {
+			return nil, err
+		}
+		if rr.class != classINET {
+			continue
+		}
+		switch {
+		case rr.typ == qtype && qtype == typeA && len(rr.data) == net.IPv4len,
+			rr.typ == qtype && qtype == typeAAAA && len(rr.data) == net.IPv6len:
+			ans.ips = append(ans.ips, net.IP(append([]byte(nil), rr.data...)))
+		case rr.typ == typeCNAME:
+		default:
+			continue
+		}
+		// the chain of CNAMEs leading to the addresses expires with its shortest lived record
+		if int64(rr.ttl) < minTTL {
+			minTTL = int64(rr.ttl)
+		}
+	}
+	if len(ans.ips) > 0 {
+		ans.ttl = minTTL
+		return ans, nil
+	}
+
+	for i := 0; i < nsCount; i++ {
+		var rr record
+		if rr, off, err = readRecord(b, off); err != nil {
+			return nil, err
+		}
+		if rr.typ != typeSOA {
+			continue
+		}
+		// MNAME and RNAME followed by SERIAL, REFRESH, RETRY, EXPIRE and MINIMUM
+		soaOff, err := skipName(b, rr.dataOff)
+		if err == nil {
+			soaOff, err = skipName(b, soaOff)
+		}
+		if err != nil || soaOff+20 > rr.dataOff+len(rr.data) {
+			return nil, fmt.Errorf("invalid SOA record in dns response")
+		}
+		ans.ttl = int64(rr.ttl)
+		if minimum := int64(binary.BigEndian.Uint32(b[soaOff+16:])); minimum < ans.ttl {
+			ans.ttl = minimum
+		}
+		break
+	}
+	return ans, nil
+}
+
+// equalQuestion reports whether b starts with question (an uncompressed name, QTYPE and QCLASS), the name is compared case insensitively.
+func equalQuestion(b []byte, question []byte) bool {
+	if len(b) < len(question) {
+		return false
+	}
+	for i, c := range question {
+		if lowerASCII(b[i]) != lowerASCII(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+type record struct {
+	typ, class uint16
+	ttl        uint32
+	data       []byte
+	dataOff    int // the offset of data in the message (the names it holds may point before it)
+}
+
+// readRecord reads the resource record at off and returns the offset following it.
+func readRecord(b []byte, off int) (record, int, error) {
+	off, err := skipName(b, off)
+	if err != nil {
+		return record{}, 0, err
+	}
+	if off+10 > len(b) {
+		return record{}, 0, errShortMessage
+	}
+	rr := record{
+		typ:   binary.BigEndian.Uint16(b[off:]),
+		class: binary.BigEndian.Uint16(b[off+2:]),
+		ttl:   binary.BigEndian.Uint32(b[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(b[off+8:]))
+	rr.dataOff = off + 10
+	if rr.dataOff+length > len(b) {
+		return record{}, 0, errShortMessage
+	}
+	rr.data = b[rr.dataOff : rr.dataOff+length]
+	return rr, rr.dataOff + length, nil
+}
+
+// skipName returns the offset following the (possibly compressed) name at off.
+func skipName(b []byte, off int) (int, error) {
+	for {
+		if off >= len(b) {
+			return 0, errShortMessage
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0:
+			// a pointer ends the name
+			if off+2 > len(b) {
+				return 0, errShortMessage
+			}
+			return off + 2, nil
+		case length&0xc0 != 0:
+			return 0, fmt.Errorf("invalid label in dns message")
+		}
+		off += 1 + length
+	}
+}
@@ -0,0 +1,348 @@
+package resolver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type testRecord struct {
+	name  []byte // wire format, possibly compressed
+	typ   uint16
+	ttl   uint32
+	data  []byte
+	class uint16 // classINET if zero
+}
+
+// wireName returns name in wire format.
+func wireName(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := appendName(nil, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// pointer returns a compression pointer to off.
+func pointer(off int) []byte {
+	return []byte{0xc0 | byte(off>>8), byte(off)}
+}
+
+// soaData returns the RDATA of a SOA record with the given MINIMUM.
+func soaData(t *testing.T, minimum uint32) []byte {
+	data := append(wireName(t, "ns.example.com"), wireName(t, "admin.example.com")...)
+	var numbers [20]byte
+	binary.BigEndian.PutUint32(numbers[0:], 1)        // SERIAL
+	binary.BigEndian.PutUint32(numbers[4:], 7200)     // REFRESH
+	binary.BigEndian.PutUint32(numbers[8:], 3600)     // RETRY
+	binary.BigEndian.PutUint32(numbers[12:], 1209600) // EXPIRE
+	binary.BigEndian.PutUint32(numbers[16:], minimum)
+	return append(data, numbers[:]...)
+}
+
+// buildResponse answers query with rcode and the given answer and authority records.
+func buildResponse(query []byte, rcode int, answers, authority []testRecord) []byte {
+	b := make([]byte, len(query))
+	copy(b, query)
+	binary.BigEndian.PutUint16(b[2:], flagResponse|flagRecursionDesired|uint16(rcode))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(authority)))
+	for _, rr := range append(append([]testRecord(nil), answers...), authority...) {
+		class := rr.class
+		if class == 0 {
+			class = classINET
+		}
+		b = append(b, rr.name...)
+		var fixed [10]byte
+		binary.BigEndian.PutUint16(fixed[0:], rr.typ)
+		binary.BigEndian.PutUint16(fixed[2:], class)
+		binary.BigEndian.PutUint32(fixed[4:], rr.ttl)
+		binary.BigEndian.PutUint16(fixed[8:], uint16(len(rr.data)))
+		b = append(b, fixed[:]...)
+		b = append(b, rr.data...)
+	}
+	return b
+}
+
+func TestParseResponse(t *testing.T) {
+	query, err := newQuery(0x1234, "www.example.com", typeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	questionName := pointer(headerLen)
+	answerOff := len(query) // the offset of the first answer record
+
+	tests := []struct {
+		name     string
+		response func() []byte
+		want     *answer
+		wantErr  bool
+	}{
+		{
+			name: "compressed name",
+			response: func() []byte {
+				return buildResponse(query, rcodeSuccess, []testRecord{
+					{name: questionName, typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+					{name: questionName, typ: typeA, ttl: 200, data: []byte{192, 0, 2, 2}},
+				}, nil)
+			},
+			want: &answer{rcode: rcodeSuccess, ips: []net.IP{{192, 0, 2, 1}, {192, 0, 2, 2}}, ttl: 200},
+		},
+		{
+			name: "cname chain",
+			response: func() []byte {
+				// www.example.com CNAME web.example.com, web.example.com CNAME cdn.example.net, cdn.example.net A
+				web := append([]byte{3, 'w', 'e', 'b'}, pointer(headerLen+4)...)
+				webOff := answerOff + 2 + 10
+				cdn := wireName(t, "cdn.example.net")
+				cdnOff := webOff + len(web) + 10
+				return buildResponse(query, rcodeSuccess, []testRecord{
+					{name: questionName, typ: typeCNAME, ttl: 3600, data: web},
+					{name: pointer(webOff), typ: typeCNAME, ttl: 60, data: cdn},
+					{name: pointer(cdnOff), typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+			},
+			want: &answer{rcode: rcodeSuccess, ips: []net.IP{{192, 0, 2, 1}}, ttl: 60},
+		},
+		{
+			name: "other types and classes are ignored",
+			response: func() []byte {
+				return buildResponse(query, rcodeSuccess, []testRecord{
+					{name: questionName, typ: typeAAAA, ttl: 10, data: net.ParseIP("2001:db8::1")},
+					{name: questionName, typ: typeA, ttl: 10, data: []byte{192, 0, 2, 9}, class: 3},
+					{name: questionName, typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+			},
+			want: &answer{rcode: rcodeSuccess, ips: []net.IP{{192, 0, 2, 1}}, ttl: 300},
+		},
+		{
+			name: "pointer loop",
+			response: func() []byte {
+				// names are skipped without following their pointers, a name pointing to itself is not a loop
+				return buildResponse(query, rcodeSuccess, []testRecord{
+					{name: pointer(answerOff), typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+			},
+			want: &answer{rcode: rcodeSuccess, ips: []net.IP{{192, 0, 2, 1}}, ttl: 300},
+		},
+		{
+			name: "nxdomain soa minimum",
+			response: func() []byte {
+				return buildResponse(query, rcodeNameError, nil, []testRecord{
+					{name: wireName(t, "example.com"), typ: typeSOA, ttl: 3600, data: soaData(t, 60)},
+				})
+			},
+			want: &answer{rcode: rcodeNameError, ttl: 60},
+		},
+		{
+			name: "nxdomain soa ttl",
+			response: func() []byte {
+				return buildResponse(query, rcodeNameError, nil, []testRecord{
+					{name: wireName(t, "example.com"), typ: typeSOA, ttl: 30, data: soaData(t, 86400)},
+				})
+			},
+			want: &answer{rcode: rcodeNameError, ttl: 30},
+		},
+		{
+			name: "nodata without soa",
+			response: func() []byte {
+				return buildResponse(query, rcodeSuccess, nil, nil)
+			},
+			want: &answer{rcode: rcodeSuccess, ttl: -1},
+		},
+		{
+			name: "question case",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, []testRecord{
+					{name: questionName, typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+				copy(b[headerLen+1:], "WwW")
+				return b
+			},
+			want: &answer{rcode: rcodeSuccess, ips: []net.IP{{192, 0, 2, 1}}, ttl: 300},
+		},
+		{
+			name: "question name mismatch",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, []testRecord{
+					{name: questionName, typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+				copy(b[headerLen+1:], "wwx")
+				return b
+			},
+			wantErr: true,
+		},
+		{
+			name: "question type mismatch",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, nil, nil)
+				binary.BigEndian.PutUint16(b[len(query)-4:], typeAAAA)
+				return b
+			},
+			wantErr: true,
+		},
+		{
+			name: "question class mismatch",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, nil, nil)
+				binary.BigEndian.PutUint16(b[len(query)-2:], 3)
+				return b
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing question",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, nil, nil)
+				binary.BigEndian.PutUint16(b[4:], 0)
+				return b[:headerLen]
+			},
+			wantErr: true,
+		},
+		{
+			name: "id mismatch",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, nil, nil)
+				b[1]++
+				return b
+			},
+			wantErr: true,
+		},
+		{
+			name: "not a response",
+			response: func() []byte {
+				return append([]byte(nil), query...)
+			},
+			wantErr: true,
+		},
+		{
+			name:     "short header",
+			response: func() []byte { return query[:headerLen-1] },
+			wantErr:  true,
+		},
+		{
+			name: "truncated rdata",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, []testRecord{
+					{name: questionName, typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+				return b[:len(b)-2]
+			},
+			wantErr: true,
+		},
+		{
+			name: "truncated record header",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, []testRecord{
+					{name: questionName, typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+				return b[:answerOff+2+5]
+			},
+			wantErr: true,
+		},
+		{
+			name: "truncated pointer",
+			response: func() []byte {
+				b := buildResponse(query, rcodeSuccess, nil, nil)
+				binary.BigEndian.PutUint16(b[6:], 1)
+				return append(b, 0xc0)
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid label",
+			response: func() []byte {
+				return buildResponse(query, rcodeSuccess, []testRecord{
+					{name: []byte{0x80, 0}, typ: typeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+				}, nil)
+			},
+			wantErr: true,
+		},
+		{
+			name: "short soa",
+			response: func() []byte {
+				return buildResponse(query, rcodeNameError, nil, []testRecord{
+					{name: wireName(t, "example.com"), typ: typeSOA, ttl: 3600, data: soaData(t, 60)[:30]},
+				})
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseResponse(test.response(), query)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseResponse() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseResponse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseResponse() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseResponseShortMessage(t *testing.T) {
+	query, err := newQuery(1, "example.com", typeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buildResponse(query, rcodeSuccess, []testRecord{
+		{name: pointer(headerLen), typ: typeAAAA, ttl: 300, data: net.ParseIP("2001:db8::1")},
+	}, nil)
+	// every prefix of a valid response is rejected without panicking
+	for n := 0; n < len(b); n++ {
+		if _, err := parseResponse(b[:n], query); err == nil {
+			t.Errorf("parseResponse() of %d of %d bytes succeeded", n, len(b))
+		}
+	}
+	if _, err := parseResponse(b[:len(query)+2], query); !errors.Is(err, errShortMessage) {
+		t.Errorf("parseResponse() error = %v, want %v", err, errShortMessage)
+	}
+}
+
+func TestNewQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "example.com", want: []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		{name: "example.com.", want: []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		{name: "", wantErr: true},
+		{name: ".", wantErr: true},
+		{name: "a..b", wantErr: true},
+		{name: string(make([]byte, 64)) + ".com", wantErr: true},
+	}
+	for _, test := range tests {
+		query, err := newQuery(0xabcd, test.name, typeA)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("newQuery(%q) succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newQuery(%q) error = %v", test.name, err)
+			continue
+		}
+		if binary.BigEndian.Uint16(query) != 0xabcd || binary.BigEndian.Uint16(query[4:]) != 1 {
+			t.Errorf("newQuery(%q) header = %x", test.name, query[:headerLen])
+		}
+		question := query[headerLen:]
+		if got := question[:len(question)-4]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("newQuery(%q) name = %v, want %v", test.name, got, test.want)
+		}
+		if binary.BigEndian.Uint16(question[len(question)-4:]) != typeA || binary.BigEndian.Uint16(question[len(question)-2:]) != classINET {
+			t.Errorf("newQuery(%q) type and class = %x", test.name, question[len(question)-4:])
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+// Route sends the names equal to Suffix or ending with "."+Suffix to Resolver.
+type Route struct {
+	Suffix   string
+	Server   string
+	Resolver utils.Resolver
+}
+
+// SplitConfig holds the overrides and routes of a Split resolver.
+type SplitConfig struct {
+	// Hosts are names (lowercase, without the trailing dot) answered with fixed addresses, before any route is looked at.
+	Hosts map[string][]net.IP
+	// Routes are sorted by the length of their suffix (the longest first) so the most specific one is used.
+	Routes []Route
+	// Default resolves the names no route matches (nil uses the fallback resolver of the Split).
+	Default utils.Resolver
+}
+
+// LoadSplit reads a split dns file, see ParseSplit for the format.
+func LoadSplit(path string, newResolver func(server string) (utils.Resolver, error)) (*SplitConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := ParseSplit(f, newResolver)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return c, nil
+}
+
+// ParseSplit reads host overrides (as in a hosts file) and routes, one per line:
+//
+//	# address name [name...]
+//	10.0.0.5 db.test db
+//	fd00::5 db.test
+//	# route suffix server
+//	route corp.internal 10.0.0.53:53
+//	route example.org https://dns.example.org/dns-query
+//	route * tls://9.9.9.9
+//
+// server is given as for FromURL (newResolver creates its resolver), 'system' is the system resolver.
+// '*' routes the names no other route matches (by default the fallback resolver of the Split does).
+func ParseSplit(r io.Reader, newResolver func(server string) (utils.Resolver, error)) (*SplitConfig, error) {
+	c := &SplitConfig{Hosts: make(map[string][]net.IP)}
+	suffixes := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%d: expected a name after -> (%s) <-", lineNumber, fields[0])
+			}
+			for _, name := range fields[1:] {
+				name = normalizeName(name)
+				c.Hosts[name] = append(c.Hosts[name], ip)
+			}
+			continue
+		}
+		if fields[0] != "route" {
+			return nil, fmt.Errorf("%d: expected an address or 'route' -> (%s) <-", lineNumber, fields[0])
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%d: expected 'route suffix server'", lineNumber)
+		}
+		resolver, err := newSplitResolver(fields[2], newResolver)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", lineNumber, err)
+		}
+		if fields[1] == "*" {
+			c.Default = resolver
+			continue
+		}
+		suffix := normalizeName(strings.TrimPrefix(fields[1], "*."))
+		if suffix == "" || suffixes[suffix] {
+			return nil, fmt.Errorf("%d: invalid or repeated suffix -> (%s) <-", lineNumber, fields[1])
+		}
+		suffixes[suffix] = true
+		c.Routes = append(c.Routes, Route{Suffix: suffix, Server: fields[2], Resolver: resolver})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(c.Routes, func(i, j int) bool { return len(c.Routes[i].Suffix) > len(c.Routes[j].Suffix) })
+	return c, nil
+}
+
+func newSplitResolver(server string, newResolver func(server string) (utils.Resolver, error)) (utils.Resolver, error) {
+	if server == "system" {
+		return utils.DefaultResolver{}, nil
+	}
+	return newResolver(server)
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
+
+// Split is a Resolver answering the names of its host overrides itself and sending the others
+// to the resolver of the route with the longest matching suffix, its configuration can be replaced while it is used.
+type Split struct {
+	fallback utils.Resolver
+
+	mu     sync.RWMutex
+	config *SplitConfig
+}
+
+// NewSplit returns a Split resolver using config, fallback resolves the names no route matches if config has no default.
+func NewSplit(config *SplitConfig, fallback utils.Resolver) *Split {
+	return &Split{fallback: fallback, config: config}
+}
+
+// Update replaces the overrides and routes, resolutions already running are not affected.
+func (s *Split) Update(config *SplitConfig) {
+	s.mu.Lock()
+	s.config = config
+	s.mu.Unlock()
+}
+
+func (s *Split) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	ips, _, err := s.ResolveTTL(ctx, name)
+	return ips, err
+}
+
+// ResolveTTL passes on the TTL of the resolver the name is routed to (-1 if it does not tell),
+// host overrides have a TTL of 0 as they can change on any reload.
+func (s *Split) ResolveTTL(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	s.mu.RLock()
+	config := s.config
+	s.mu.RUnlock()
+
+	key := normalizeName(name)
+	if ips, ok := config.Hosts[key]; ok {
+		return ips, 0, nil
+	}
+	r := s.route(config, key)
+	if tr, ok := r.(TTLResolver); ok {
+		return tr.ResolveTTL(ctx, name)
+	}
+	ips, err := r.Resolve(ctx, name)
+	return ips, -1, err
+}
+
+func (s *Split) route(config *SplitConfig, name string) utils.Resolver {
+	for _, route := range config.Routes {
+		if name == route.Suffix || strings.HasSuffix(name, "."+route.Suffix) {
+			return route.Resolver
+		}
+	}
+	if config.Default != nil {
+		return config.Default
+	}
+	return s.fallback
+}
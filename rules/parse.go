@@ -0,0 +1,176 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/OmarTariq612/socks-server/egress"
+)
+
+// Load reads a rules file, see Parse for the format.
+func Load(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return rs, nil
+}
+
+// Parse reads rules, one per line in order of evaluation:
+//
+//	# comment
+//	allow user=alice,bob dest=10.0.0.0/8 port=22,8000-9000
+//	deny client=192.168.1.0/24 cmd=bind,udp
+//	deny domain=*.example.com,.example.org,/^ads\./
+//	allow name=bulk port=873
+//	default deny
+//
+// keys are client, user, cmd (connect, bind, udp), dest (IP or CIDR), domain, port (port or range) and name (not used for matching),
+// a regular expression domain takes the whole value (use the key again for other domains).
+// requests that match no rule are denied unless "default allow" is given.
+func Parse(r io.Reader) (*RuleSet, error) {
+	rs := &RuleSet{Default: Deny}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "default" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%d: expected 'default allow' or 'default deny'", lineNumber)
+			}
+			action, err := parseAction(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%d: %v", lineNumber, err)
+			}
+			rs.Default = action
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", lineNumber, err)
+		}
+		rs.Rules = append(rs.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseAction(s string) (Action, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "deny":
+		return Deny, nil
+	default:
+		return Deny, fmt.Errorf("invalid action -> (%s) <-", s)
+	}
+}
+
+func parseRule(fields []string) (*Rule, error) {
+	action, err := parseAction(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{Action: action}
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found || value == "" {
+			return nil, fmt.Errorf("expected 'key=value' -> (%s) <-", field)
+		}
+		values := strings.Split(value, ",")
+		if key == "domain" && len(value) >= 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+			values = []string{value}
+		}
+		for _, v := range values {
+			if err := rule.add(key, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rule, nil
+}
+
+func (r *Rule) add(key, value string) error {
+	switch key {
+	case "client":
+		nets, err := egress.ParseCIDRs(value)
+		if err != nil {
+			return err
+		}
+		r.Clients = append(r.Clients, nets...)
+	case "name":
+		r.Name = value
+	case "user":
+		r.Users = append(r.Users, value)
+	case "cmd":
+		c, err := parseCommand(value)
+		if err != nil {
+			return err
+		}
+		r.Commands = append(r.Commands, c)
+	case "dest":
+		nets, err := egress.ParseCIDRs(value)
+		if err != nil {
+			return err
+		}
+		r.Dests = append(r.Dests, nets...)
+	case "domain":
+		m, err := NewDomainMatcher(value)
+		if err != nil {
+			return fmt.Errorf("invalid domain -> (%s) <-: %v", value, err)
+		}
+		r.Domains = append(r.Domains, m)
+	case "port":
+		p, err := parsePortRange(value)
+		if err != nil {
+			return err
+		}
+		r.Ports = append(r.Ports, p)
+	default:
+		return fmt.Errorf("unknown key -> (%s) <-", key)
+	}
+	return nil
+}
+
+func parseCommand(s string) (Command, error) {
+	switch strings.ToLower(s) {
+	case "connect":
+		return Connect, nil
+	case "bind":
+		return Bind, nil
+	case "udp":
+		return UDPAssociate, nil
+	default:
+		return 0, fmt.Errorf("invalid command -> (%s) <-", s)
+	}
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	from, err := strconv.ParseUint(fromStr, 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port -> (%s) <-", s)
+	}
+	to := from
+	if isRange {
+		to, err = strconv.ParseUint(toStr, 10, 16)
+		if err != nil || to < from {
+			return PortRange{}, fmt.Errorf("invalid port range -> (%s) <-", s)
+		}
+	}
+	return PortRange{From: uint16(from), To: uint16(to)}, nil
+}
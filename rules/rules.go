@@ -0,0 +1,265 @@
+package rules
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+type Action byte
+
+const (
+	Deny Action = iota
+	Allow
+)
+
+func (a Action) String() string {
+	if a == Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+type Command byte
+
+const (
+	Connect Command = iota + 1
+	Bind
+	UDPAssociate
+)
+
+func (c Command) String() string {
+	switch c {
+	case Connect:
+		return "connect"
+	case Bind:
+		return "bind"
+	case UDPAssociate:
+		return "udp"
+	default:
+		return "unknown"
+	}
+}
+
+// Request is what the rules are evaluated against.
+type Request struct {
+	ClientIP net.IP
+	// User is the authenticated username (empty for anonymous clients).
+	User    string
+	Command Command
+	// DestHost is the requested domain name (empty if the client requested an IP).
+	DestHost string
+	// DestIP is the requested or resolved IP (nil if the domain name was not resolved locally).
+	DestIP   net.IP
+	DestPort uint16
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return r.From <= port && port <= r.To
+}
+
+// DomainMatcher matches a domain name exactly, by suffix ("*.example.com" matches subdomains only,
+// ".example.com" matches the domain and its subdomains) or by a regular expression.
+type DomainMatcher struct {
+	exact  string
+	suffix string
+	apex   bool // the suffix matches the domain itself as well
+	re     *regexp.Regexp
+}
+
+// NewDomainMatcher parses pattern, a regular expression is written between slashes (/^ads\./).
+func NewDomainMatcher(pattern string) (DomainMatcher, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return DomainMatcher{}, err
+		}
+		return DomainMatcher{re: re}, nil
+	}
+	pattern = normalizeDomain(pattern)
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		return DomainMatcher{suffix: pattern[1:]}, nil
+	case strings.HasPrefix(pattern, "."):
+		return DomainMatcher{suffix: pattern, apex: true}, nil
+	default:
+		return DomainMatcher{exact: pattern}, nil
+	}
+}
+
+func (m DomainMatcher) Match(domain string) bool {
+	domain = normalizeDomain(domain)
+	switch {
+	case m.re != nil:
+		return m.re.MatchString(domain)
+	case m.suffix != "":
+		return strings.HasSuffix(domain, m.suffix) || (m.apex && domain == m.suffix[1:])
+	default:
+		return domain == m.exact
+	}
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// Rule matches a request when every non empty criterion matches (a criterion matches if any of its values does).
+type Rule struct {
+	// Name identifies the rule (such as for per rule bandwidth limits), it is optional and not used for matching.
+	Name     string
+	Action   Action
+	Clients  []*net.IPNet
+	Users    []string
+	Commands []Command
+	Dests    []*net.IPNet
+	Domains  []DomainMatcher
+	Ports    []PortRange
+}
+
+func (r *Rule) Match(req *Request) bool {
+	return r.matchSource(req) && r.matchDest(req)
+}
+
+func (r *Rule) matchSource(req *Request) bool {
+	if len(r.Clients) > 0 && !containsIP(r.Clients, req.ClientIP) {
+		return false
+	}
+	if len(r.Users) > 0 && !containsString(r.Users, req.User) {
+		return false
+	}
+	if len(r.Commands) > 0 && !containsCommand(r.Commands, req.Command) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) matchDest(req *Request) bool {
+	if len(r.Dests) > 0 && !containsIP(r.Dests, req.DestIP) {
+		return false
+	}
+	if len(r.Domains) > 0 {
+		if req.DestHost == "" {
+			return false
+		}
+		matched := false
+		for _, domain := range r.Domains {
+			if domain.Match(req.DestHost) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, ports := range r.Ports {
+			if ports.contains(req.DestPort) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Rule) hasDestCriteria() bool {
+	return len(r.Dests) > 0 || len(r.Domains) > 0 || len(r.Ports) > 0
+}
+
+// RuleSet is an ordered list of rules, the first matching rule decides.
+type RuleSet struct {
+	Rules []*Rule
+	// Default is the action taken when no rule matches.
+	Default Action
+}
+
+// Match returns the first rule matching req (nil if none does or rs is nil).
+func (rs *RuleSet) Match(req *Request) *Rule {
+	if rs == nil {
+		return nil
+	}
+	for _, rule := range rs.Rules {
+		if rule.Match(req) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Allow reports whether req is allowed, a nil RuleSet allows everything.
+func (rs *RuleSet) Allow(req *Request) bool {
+	allowed, _ := rs.Decide(req)
+	return allowed
+}
+
+// Decide reports whether req is allowed and returns the rule that decided it (nil if the default action did).
+func (rs *RuleSet) Decide(req *Request) (bool, *Rule) {
+	if rs == nil {
+		return true, nil
+	}
+	if rule := rs.Match(req); rule != nil {
+		return rule.Action == Allow, rule
+	}
+	return rs.Default == Allow, nil
+}
+
+// AllowAny reports whether req could be allowed for at least one destination, its destination fields are ignored.
+// it is used to accept a UDP association before its datagrams (each checked using Allow) are known.
+func (rs *RuleSet) AllowAny(req *Request) bool {
+	if rs == nil {
+		return true
+	}
+	for _, rule := range rs.Rules {
+		if !rule.matchSource(req) {
+			continue
+		}
+		if !rule.hasDestCriteria() {
+			return rule.Action == Allow
+		}
+		if rule.Action == Allow {
+			return true
+		}
+	}
+	return rs.Default == Allow
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCommand(commands []Command, c Command) bool {
+	for _, command := range commands {
+		if command == c {
+			return true
+		}
+	}
+	return false
+}
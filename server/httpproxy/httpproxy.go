@@ -0,0 +1,405 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/connlimit"
+	"github.com/OmarTariq612/socks-server/logging"
+	"github.com/OmarTariq612/socks-server/metrics"
+	"github.com/OmarTariq612/socks-server/ratelimit"
+	"github.com/OmarTariq612/socks-server/relay"
+	"github.com/OmarTariq612/socks-server/rules"
+	"github.com/OmarTariq612/socks-server/server/socks5/auth"
+	"github.com/OmarTariq612/socks-server/session"
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+const proxyAuthRealm = `Basic realm="socks-server"`
+
+// proxyBasicAuthMethod is the auth.Identity method of clients authenticated by the Proxy-Authorization header.
+const proxyBasicAuthMethod = "HTTP PROXY BASIC"
+
+// hop-by-hop headers that must not be forwarded (rfc 7230 section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Handler serves HTTP proxy connections, every SocksServer has its own.
+type Handler struct {
+	config     *utils.Config
+	validators []auth.CredentialsValidator
+	// credentialsRequired rejects the requests without a Proxy-Authorization header.
+	credentialsRequired bool
+}
+
+// NewHandler returns a Handler sharing config with the socks handlers, clients are authenticated as socks5 clients would be with methods:
+// a Proxy-Authorization header is checked against the methods validating credentials (username/password)
+// and it may only be omitted if NoAuth is one of methods as well (or none of them validates credentials).
+func NewHandler(config *utils.Config, methods []auth.AuthMethod) (*Handler, error) {
+	h := &Handler{config: config, credentialsRequired: auth.CredentialsRequired(methods)}
+	for _, method := range methods {
+		if validator, ok := method.(auth.CredentialsValidator); ok {
+			h.validators = append(h.validators, validator)
+		}
+	}
+	return h, nil
+}
+
+// HandleConnection serves a single HTTP proxy request (CONNECT or an absolute-form request such as GET http://...).
+func (h *Handler) HandleConnection(ctx context.Context, conn net.Conn) error {
+	c := newClient(h, conn)
+	return c.handle(ctx)
+}
+
+type client struct {
+	h        *Handler
+	conn     net.Conn
+	br       *bufio.Reader
+	req      *http.Request
+	identity *auth.Identity
+	sess     *session.Session
+	log      logging.Logger
+	// ruleName is the name of the rule that allowed the request (empty if none), used for per rule limits.
+	ruleName string
+}
+
+func newClient(h *Handler, conn net.Conn) *client {
+	return &client{h: h, conn: conn, br: bufio.NewReader(conn)}
+}
+
+func (c *client) handle(ctx context.Context) error {
+	c.sess = session.FromContext(ctx)
+	c.log = logging.With(c.h.config.Logger, "session", c.sess.ID)
+	m := c.h.config.Metrics
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		m.HandshakeRejected(metrics.VersionHTTP, "bad_request")
+		c.sendStatus(http.StatusBadRequest, nil)
+		return fmt.Errorf("could not read http request, %v", err)
+	}
+	c.req = req
+	// the handshake timeout (set by the server) only covers reading the request
+	c.conn.SetDeadline(time.Time{})
+
+	identity, ok := c.h.authenticate(req)
+	if !ok {
+		if req.Header.Get("Proxy-Authorization") != "" {
+			// a missing header is the usual first step of the challenge, not a failure
+			m.AuthFailed(proxyBasicAuthMethod)
+		}
+		m.HandshakeRejected(metrics.VersionHTTP, "auth_failed")
+		header := make(http.Header)
+		header.Set("Proxy-Authenticate", proxyAuthRealm)
+		c.sendStatus(http.StatusProxyAuthRequired, header)
+		return auth.ErrAuthFailed
+	}
+	c.identity = identity
+	c.sess.AuthMethod = identity.Method
+	c.sess.User = identity.Username
+	c.log.Debug("http proxy request", "method", req.Method, "target", req.RequestURI, "user", identity.Username, "auth_method", identity.Method)
+	ctx = auth.NewContext(ctx, identity)
+
+	release, err := c.h.config.SessionLimit.Acquire(connlimit.TCP, identity.Username, utils.IPFromAddr(c.conn.RemoteAddr()))
+	if err != nil {
+		m.HandshakeRejected(metrics.VersionHTTP, "limit_reached")
+		c.sendStatus(http.StatusTooManyRequests, nil)
+		return utils.NewRequestError("limit", err)
+	}
+	defer release()
+
+	if req.Method == http.MethodConnect {
+		c.sess.Command = "connect"
+		return c.handleConnect(ctx)
+	}
+	c.sess.Command = "forward"
+	return c.handleForward(ctx)
+}
+
+func (c *client) handleConnect(ctx context.Context) error {
+	addr := c.req.Host
+	c.sess.RequestedDest = addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		c.h.config.Metrics.HandshakeRejected(metrics.VersionHTTP, "bad_request")
+		c.sendStatus(http.StatusBadRequest, nil)
+		return fmt.Errorf("invalid CONNECT target -> (%s) <-", addr)
+	}
+	serverConn, err := c.dial(ctx, addr)
+	if err != nil {
+		c.sendDialFailure(err)
+		return err
+	}
+	defer serverConn.Close()
+	defer c.h.config.Metrics.SessionStarted(metrics.VersionHTTP, "connect")()
+
+	_, err = io.WriteString(c.conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		return fmt.Errorf("could not write CONNECT response to the client")
+	}
+	c.sess.ReplyCode = http.StatusOK
+	c.log.Debug("connected", "dest", serverConn.RemoteAddr(), "local", serverConn.LocalAddr())
+
+	limits := c.acquireLimits()
+	defer limits.Release()
+	result := relay.Relay(limits.Conn(c.clientConn()), serverConn, c.h.config.IdleTimeout)
+	c.h.config.Metrics.AddRelayed(metrics.VersionHTTP, result.Up, result.Down)
+	c.sess.AddBytes(result.Up, result.Down)
+	return result.Err()
+}
+
+// handleForward forwards a plain (absolute-form) request to the origin server and relays its response,
+// the connection is closed afterwards.
+func (c *client) handleForward(ctx context.Context) error {
+	c.sess.RequestedDest = c.req.URL.Host
+	if c.req.URL.Scheme != "http" || c.req.URL.Host == "" {
+		c.h.config.Metrics.HandshakeRejected(metrics.VersionHTTP, "bad_request")
+		c.sendStatus(http.StatusBadRequest, nil)
+		return fmt.Errorf("unsupported proxy request -> (%s %s) <-", c.req.Method, c.req.URL)
+	}
+	addr := c.req.URL.Host
+	if c.req.URL.Port() == "" {
+		addr = net.JoinHostPort(c.req.URL.Hostname(), "80")
+		c.sess.RequestedDest = addr
+	}
+	serverConn, err := c.dial(ctx, addr)
+	if err != nil {
+		c.sendDialFailure(err)
+		return err
+	}
+	defer serverConn.Close()
+	defer c.h.config.Metrics.SessionStarted(metrics.VersionHTTP, "forward")()
+	// the request body is read through c.br so the limits apply on the server side
+	limits := c.acquireLimits()
+	defer limits.Release()
+	serverConn = limits.ServerConn(serverConn)
+	up := &countingWriter{w: serverConn}
+	down := &countingWriter{w: c.conn}
+	defer func() {
+		c.h.config.Metrics.AddRelayed(metrics.VersionHTTP, up.n, down.n)
+		c.sess.AddBytes(up.n, down.n)
+	}()
+
+	removeHopByHopHeaders(c.req.Header)
+	if _, ok := c.req.Header["User-Agent"]; !ok {
+		// prevent (*http.Request).Write from adding its default user agent
+		c.req.Header["User-Agent"] = []string{}
+	}
+	c.req.Close = true
+	if err := c.req.Write(up); err != nil {
+		c.sendStatus(http.StatusBadGateway, nil)
+		return fmt.Errorf("could not forward the request to the server, %v", err)
+	}
+
+	idle := utils.NewIdleTimer(c.h.config.IdleTimeout, func() {
+		c.conn.Close()
+		serverConn.Close()
+	})
+	defer idle.Stop()
+
+	resp, err := http.ReadResponse(bufio.NewReader(idle.Reader(serverConn)), c.req)
+	if err != nil {
+		c.sendStatus(http.StatusBadGateway, nil)
+		return fmt.Errorf("could not read the response from the server, %v", err)
+	}
+	defer resp.Body.Close()
+	removeHopByHopHeaders(resp.Header)
+	resp.Close = true
+	c.sess.ReplyCode = resp.StatusCode
+	if err := resp.Write(down); err != nil {
+		return fmt.Errorf("could not write the response to the client, %v", err)
+	}
+	return nil
+}
+
+// dial resolves the host the same way the socks handlers do and checks the rules before dialing addr,
+// the allowed addresses of a resolved host are raced (Happy Eyeballs).
+func (c *client) dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port -> (%s) <-", portStr)
+	}
+	req := &rules.Request{
+		ClientIP: utils.IPFromAddr(c.conn.RemoteAddr()),
+		User:     c.identity.Username,
+		Command:  rules.Connect,
+		DestIP:   net.ParseIP(host),
+		DestPort: uint16(port),
+	}
+	var destIPs []net.IP
+	if req.DestIP == nil {
+		req.DestHost = host
+		if c.h.config.RemoteDNS == nil || !c.h.config.RemoteDNS(host) {
+			resolvedIPs, err := utils.ResolveIPs(ctx, c.h.config.Resolv, c.h.config.IPPolicy, host)
+			if err != nil {
+				c.h.config.Metrics.HandshakeRejected(metrics.VersionHTTP, "resolve_failed")
+				return nil, utils.NewRequestError("resolve", err)
+			}
+			destIPs = resolvedIPs
+			req.DestIP = resolvedIPs[0]
+		}
+	}
+	if req.DestIP != nil {
+		c.sess.ResolvedDest = net.JoinHostPort(req.DestIP.String(), portStr)
+	}
+	destIPs, allowed := c.allowed(req, destIPs)
+	if !allowed {
+		c.h.config.Metrics.HandshakeRejected(metrics.VersionHTTP, "not_allowed")
+		return nil, utils.NewRequestError("rules", fmt.Errorf("[http] request to (%s): %w", addr, utils.ErrNotAllowed))
+	}
+	c.h.config.Metrics.HandshakeAccepted(metrics.VersionHTTP)
+	if len(destIPs) == 0 {
+		conn, err := c.h.config.Dial(ctx, "tcp", addr)
+		if err != nil {
+			return nil, utils.NewRequestError("dial", err)
+		}
+		return conn, nil
+	}
+	conn, dialedAddr, err := utils.DialHappyEyeballs(ctx, c.h.config.Dial, "tcp", destIPs, portStr, c.h.config.AttemptDelay)
+	if err != nil {
+		return nil, utils.NewRequestError("dial", err)
+	}
+	c.sess.ResolvedDest = dialedAddr
+	return conn, nil
+}
+
+// allowed evaluates the rules against req, every address of destIPs (the resolved host, if any) is checked
+// and the allowed ones are returned.
+func (c *client) allowed(req *rules.Request, destIPs []net.IP) ([]net.IP, bool) {
+	if len(destIPs) == 0 {
+		allowed, rule := c.h.config.Rules.Decide(req)
+		if rule != nil {
+			c.ruleName = rule.Name
+		}
+		return nil, allowed
+	}
+	var allowedIPs []net.IP
+	for _, ip := range destIPs {
+		req.DestIP = ip
+		allowed, rule := c.h.config.Rules.Decide(req)
+		if !allowed {
+			continue
+		}
+		if len(allowedIPs) == 0 && rule != nil {
+			c.ruleName = rule.Name
+		}
+		allowedIPs = append(allowedIPs, ip)
+	}
+	return allowedIPs, len(allowedIPs) > 0
+}
+
+func (c *client) acquireLimits() *ratelimit.Session {
+	return c.h.config.RateLimit.Acquire(c.identity.Username, utils.IPFromAddr(c.conn.RemoteAddr()), c.ruleName)
+}
+
+func (c *client) sendDialFailure(err error) error {
+	switch utils.Classify(err) {
+	case utils.KindNotAllowed:
+		return c.sendStatus(http.StatusForbidden, nil)
+	case utils.KindTimeout:
+		return c.sendStatus(http.StatusGatewayTimeout, nil)
+	default:
+		return c.sendStatus(http.StatusBadGateway, nil)
+	}
+}
+
+// authenticate checks the Proxy-Authorization header (if it is sent or credentials are required) and returns the client identity.
+func (h *Handler) authenticate(req *http.Request) (*auth.Identity, bool) {
+	if len(h.validators) == 0 {
+		return &auth.Identity{Method: auth.NoAuth().String()}, true
+	}
+	username, password, ok := proxyBasicAuth(req)
+	if !ok {
+		if h.credentialsRequired {
+			return nil, false
+		}
+		return &auth.Identity{Method: auth.NoAuth().String()}, true
+	}
+	for _, validator := range h.validators {
+		if validator.ValidateCredentials(username, password) {
+			return &auth.Identity{Username: username, Method: proxyBasicAuthMethod}, true
+		}
+	}
+	return nil, false
+}
+
+// proxyBasicAuth parses the Proxy-Authorization header the same way (*http.Request).BasicAuth parses Authorization.
+func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	return r.BasicAuth()
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, name := range header.Values("Connection") {
+		for _, field := range strings.Split(name, ",") {
+			header.Del(strings.TrimSpace(field))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// clientConn returns the client connection including the bytes c.br already buffered.
+func (c *client) clientConn() net.Conn {
+	if c.br.Buffered() == 0 {
+		return c.conn
+	}
+	return &bufferedConn{Conn: c.conn, r: c.br}
+}
+
+// bufferedConn reads through r which holds bytes read ahead from Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (c *client) sendStatus(code int, header http.Header) error {
+	if header == nil {
+		header = make(http.Header)
+	}
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      true,
+	}
+	c.sess.ReplyCode = code
+	return resp.Write(c.conn)
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/metrics"
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+// instrumentedResolver records the latency and errors of every resolution of r.
+type instrumentedResolver struct {
+	r utils.Resolver
+	m *metrics.Metrics
+}
+
+func (ir *instrumentedResolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	start := time.Now()
+	ips, err := ir.r.Resolve(ctx, name)
+	ir.m.ObserveDNS(time.Since(start), utils.ResultLabel(err))
+	return ips, err
+}
+
+// instrumentDial records the latency of every call of dial, except the Happy Eyeballs attempts cancelled because another one connected.
+func instrumentDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), m *metrics.Metrics) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		if !utils.LostHappyEyeballsRace(ctx, err) {
+			m.ObserveDial(time.Since(start), utils.ResultLabel(err))
+		}
+		return conn, err
+	}
+}
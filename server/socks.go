@@ -2,15 +2,21 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/OmarTariq612/socks-server/logging"
+	"github.com/OmarTariq612/socks-server/metrics"
+	"github.com/OmarTariq612/socks-server/resolver"
+	"github.com/OmarTariq612/socks-server/server/httpproxy"
 	"github.com/OmarTariq612/socks-server/server/socks4a"
 	"github.com/OmarTariq612/socks-server/server/socks5"
 	"github.com/OmarTariq612/socks-server/server/socks5/auth"
+	"github.com/OmarTariq612/socks-server/session"
 	"github.com/OmarTariq612/socks-server/utils"
 )
 
@@ -19,68 +25,312 @@ const (
 	socksVersion5 byte = 5
 )
 
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or Close is called.
+var ErrServerClosed = errors.New("socks server closed")
+
+// SocksServer serves socks4/socks4a, socks5 and HTTP proxy clients on the same listeners,
+// every server has its own config and handlers so multiple servers can run in one process.
 type SocksServer struct {
-	config     *utils.Config
-	authMedhod []auth.AuthMethod
+	config *utils.Config
+
+	Socks4 *socks4a.Handler
+	Socks5 *socks5.Handler
+	HTTP   *httpproxy.Handler
+	// initErr is the error (invalid auth methods) found while creating the handlers, it is returned by Serve.
+	initErr error
+
+	// ctx is the parent of every connection context, it is cancelled when the server is forcibly closed
+	// which closes the BIND listeners and UDP relays and interrupts dials.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	// closing is closed once the server stops accepting, it ends the wait for a connection slot.
+	closing   chan struct{}
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	active    sync.WaitGroup
 }
 
+// NewSocksServer copies config (filling the defaults) so the caller's config is never shared between servers.
 func NewSocksServer(config *utils.Config, authMethods ...auth.AuthMethod) *SocksServer {
 	if config == nil {
 		config = &utils.Config{}
 	}
+	configCopy := *config
+	config = &configCopy
 	if config.Resolv == nil {
 		config.Resolv = utils.DefaultResolver{}
 	}
+	if config.Logger == nil {
+		config.Logger = logging.Default()
+	}
+	// a dns cache records the latency of the queries it sends itself, its hits would make the latencies meaningless
+	if _, cached := config.Resolv.(*resolver.Cache); config.Metrics != nil && !cached {
+		config.Resolv = &instrumentedResolver{r: config.Resolv, m: config.Metrics}
+	}
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = 30 * time.Second
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.AttemptDelay == 0 {
+		config.AttemptDelay = utils.DefaultAttemptDelay
+	}
 	if config.Dial == nil {
-		config.Dial = func(_ context.Context, network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, 5*time.Second)
+		dialer := &net.Dialer{}
+		if config.Egress != nil {
+			// checks the IP the socket connects to, after any resolution (dns rebinding can not bypass it)
+			dialer.Control = config.Egress.Control
 		}
+		// domain names reaching the dialer (remote dns) are resolved at this last hop using the configured resolver
+		config.Dial = utils.ResolvingDial(config.Resolv, config.IPPolicy, config.AttemptDelay, dialer.DialContext)
+	} else if config.Egress != nil {
+		config.Dial = config.Egress.WrapDial(config.Dial)
 	}
-	return &SocksServer{config: config, authMedhod: authMethods}
+	config.Dial = utils.DialWithTimeout(config.Dial, config.DialTimeout)
+	if config.ListenPacket == nil {
+		config.ListenPacket = (&net.ListenConfig{}).ListenPacket
+	}
+	if config.Metrics != nil {
+		config.Dial = instrumentDial(config.Dial, config.Metrics)
+	}
+	if config.BindTimeout == 0 {
+		config.BindTimeout = 2 * time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &SocksServer{
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		closing:   make(chan struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	s.Socks4, s.initErr = socks4a.NewHandler(config, authMethods...)
+	if s.initErr == nil {
+		s.Socks5, s.initErr = socks5.NewHandler(config, authMethods)
+	}
+	if s.initErr == nil {
+		s.HTTP, s.initErr = httpproxy.NewHandler(config, authMethods)
+	}
+	return s
 }
 
 func (s *SocksServer) ListenAndServe(network, addr string) error {
-	// init socks4 and socks5 config
-	if err := socks4a.InitConfig(s.config); err != nil {
-		return err
-	}
-	if err := socks5.InitConfig(s.config, s.authMedhod); err != nil {
-		return err
+	if s.initErr != nil {
+		return s.initErr
 	}
 	listener, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
-	log.Println("Serving on", addr)
+	s.config.Logger.Info("serving", "network", network, "addr", listener.Addr())
 	return s.Serve(listener)
 }
 
 func (s *SocksServer) Serve(l net.Listener) error {
+	if s.initErr != nil {
+		return s.initErr
+	}
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
 	for {
+		// at the connection cap new clients are left in the listen backlog until a connection ends
+		if !s.config.SessionLimit.AcquireConn(s.closing) {
+			return ErrServerClosed
+		}
 		conn, err := l.Accept()
 		if err != nil {
+			s.config.SessionLimit.ReleaseConn()
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
+		if !s.trackConn(conn) {
+			s.config.SessionLimit.ReleaseConn()
+			conn.Close()
+			return ErrServerClosed
+		}
 		go func() {
+			defer s.config.SessionLimit.ReleaseConn()
+			defer s.untrackConn(conn)
 			defer conn.Close()
+			sess := session.New(conn.RemoteAddr())
+			ctx, cancel := context.WithCancel(session.NewContext(s.ctx, sess))
+			defer cancel()
+			if s.config.MaxLifetime > 0 {
+				lifetime := time.AfterFunc(s.config.MaxLifetime, func() {
+					cancel()
+					conn.Close()
+				})
+				defer lifetime.Stop()
+			}
+			// cleared by the handlers once the request is read
+			conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
 			var buf [1]byte
 			_, err := io.ReadFull(conn, buf[:])
 			if err != nil {
-				log.Println(err)
+				s.logSession(sess, fmt.Errorf("could not read the protocol version, %v", err))
 				return
 			}
 			switch buf[0] {
 			case socksVersion4:
-				err = socks4a.HandleConnection(conn)
+				sess.Version = metrics.VersionSocks4
+				err = s.Socks4.HandleConnection(ctx, conn)
 			case socksVersion5:
-				err = socks5.HandleConnection(conn)
+				sess.Version = metrics.VersionSocks5
+				err = s.Socks5.HandleConnection(ctx, conn)
 			default:
+				if isHTTPMethodStart(buf[0]) {
+					sess.Version = metrics.VersionHTTP
+					err = s.HTTP.HandleConnection(ctx, &prefixConn{Conn: conn, prefix: buf[:]})
+					break
+				}
 				err = fmt.Errorf("unacceptable socks version -> (%d) <-", buf[0])
 			}
-			if err != nil {
-				log.Println(err)
-			}
+			s.logSession(sess, err)
 		}()
 	}
 }
+
+// logSession ends sess with err (the error the session ended with, if any), logs it and writes its access log record.
+func (s *SocksServer) logSession(sess *session.Session, err error) {
+	sess.End = time.Now()
+	sess.Err = err
+	logger := logging.With(s.config.Logger, "session", sess.ID, "client", sess.ClientAddr)
+	if err != nil {
+		args := []any{"version", sess.Version, "error", err}
+		var reqErr *utils.RequestError
+		if errors.As(err, &reqErr) {
+			args = append(args, "op", reqErr.Op, "kind", reqErr.Kind)
+		}
+		logger.Warn("session failed", args...)
+	}
+	logger.Debug("session closed", "duration", sess.End.Sub(sess.Start), "bytes_up", sess.BytesUp, "bytes_down", sess.BytesDown)
+	if err := s.config.AccessLog.Log(sess); err != nil {
+		logger.Error("could not write the access log", "error", err)
+	}
+}
+
+// Shutdown stops accepting connections and waits for the active ones to finish,
+// if ctx is done first the remaining connections are closed (as Close does) and ctx's error is returned.
+func (s *SocksServer) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes the active ones immediately
+// including their UDP associations and BIND listeners.
+func (s *SocksServer) Close() error {
+	err := s.closeListeners()
+	s.cancel()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (s *SocksServer) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.closing)
+	}
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+func (s *SocksServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *SocksServer) trackListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *SocksServer) untrackListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *SocksServer) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.active.Add(1)
+	return true
+}
+
+func (s *SocksServer) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// isHTTPMethodStart reports whether b can be the first byte of an HTTP request (methods are upper case tokens).
+func isHTTPMethodStart(b byte) bool {
+	return 'A' <= b && b <= 'Z'
+}
+
+// prefixConn replays the bytes consumed while sniffing the protocol before reading from the connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
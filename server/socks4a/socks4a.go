@@ -10,6 +10,13 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/OmarTariq612/socks-server/connlimit"
+	"github.com/OmarTariq612/socks-server/logging"
+	"github.com/OmarTariq612/socks-server/metrics"
+	"github.com/OmarTariq612/socks-server/relay"
+	"github.com/OmarTariq612/socks-server/rules"
+	"github.com/OmarTariq612/socks-server/server/socks5/auth"
+	"github.com/OmarTariq612/socks-server/session"
 	"github.com/OmarTariq612/socks-server/utils"
 )
 
@@ -17,6 +24,29 @@ import (
 
 type command byte
 
+func (c command) String() string {
+	switch c {
+	case connect:
+		return "connect"
+	case bind:
+		return "bind"
+	default:
+		return strconv.Itoa(int(c))
+	}
+}
+
+// limitKind is the kind of session counted by the session limits for the command.
+func (c command) limitKind() (connlimit.Kind, bool) {
+	switch c {
+	case connect:
+		return connlimit.TCP, true
+	case bind:
+		return connlimit.Bind, true
+	default:
+		return 0, false
+	}
+}
+
 const (
 	connect command = 1
 	bind    command = 2
@@ -45,72 +75,210 @@ const (
 
 const timeoutDuration time.Duration = 5 * time.Second
 
-var currConfig *utils.Config
+// socks4UserIDMethod is the auth.Identity method of socks4 clients.
+const socks4UserIDMethod = "SOCKS4 USERID"
+
+// userIDAttribute is the auth.Identity attribute holding the USERID sent by a socks4 client.
+const userIDAttribute = "userid"
 
-func InitConfig(config *utils.Config) error {
-	currConfig = config
-	return nil
+// Handler serves socks4 and socks4a connections, every SocksServer has its own.
+type Handler struct {
+	config *utils.Config
+	// credentialsRequired rejects every request, socks4 clients can not authenticate.
+	credentialsRequired bool
 }
 
-func HandleConnection(conn net.Conn) error {
-	c := newClient(conn)
-	return c.handle()
+// NewHandler returns a Handler sharing config with the other handlers, methods are the auth methods of the socks5 clients:
+// if they require credentials (see auth.CredentialsRequired) socks4 requests are rejected.
+func NewHandler(config *utils.Config, methods ...auth.AuthMethod) (*Handler, error) {
+	return &Handler{config: config, credentialsRequired: auth.CredentialsRequired(methods)}, nil
+}
+
+// HandleConnection serves conn whose version byte is already consumed.
+func (h *Handler) HandleConnection(ctx context.Context, conn net.Conn) error {
+	c := newClient(h, conn)
+	return c.handle(ctx)
 }
 
 type client struct {
-	conn net.Conn
-	req  *request
+	h        *Handler
+	conn     net.Conn
+	req      *request
+	identity *auth.Identity
+	sess     *session.Session
+	log      logging.Logger
+	// ruleName is the name of the rule that allowed the request (empty if none), used for per rule limits.
+	ruleName string
+	// destIPs are the addresses of a resolved domain name destination in the order they are dialed.
+	destIPs []net.IP
 }
 
-func newClient(conn net.Conn) *client {
-	return &client{conn: conn}
+func newClient(h *Handler, conn net.Conn) *client {
+	return &client{h: h, conn: conn}
 }
 
-func (c *client) handle() error {
+func (c *client) handle(ctx context.Context) error {
+	c.sess = session.FromContext(ctx)
+	c.log = logging.With(c.h.config.Logger, "session", c.sess.ID)
+	m := c.h.config.Metrics
 	req, err := parseRequest(c.conn)
 	if err != nil {
+		m.HandshakeRejected(metrics.VersionSocks4, "bad_request")
 		return err
 	}
 	c.req = req
-	ctx := context.Background()
+	// the handshake timeout (set by the server) only covers reading the request
+	c.conn.SetDeadline(time.Time{})
+	// socks4 has no authentication, the USERID field is sent by the client unchecked so it is only logged
+	// (the client is anonymous to the rules and the limits)
+	c.identity = &auth.Identity{Method: socks4UserIDMethod, Attributes: map[string]string{userIDAttribute: req.userID}}
+	ctx = auth.NewContext(ctx, c.identity)
+	c.sess.AuthMethod = c.identity.Method
+	c.sess.Command = req.cmd.String()
+	c.sess.RequestedDest = c.destAddr()
+	c.log.Debug("socks4 request", "command", req.cmd, "dest", c.sess.RequestedDest, "userid", req.userID)
+
+	if c.h.credentialsRequired {
+		m.HandshakeRejected(metrics.VersionSocks4, "no_acceptable_method")
+		c.sendFailure(requestRejectedOrFailed)
+		return fmt.Errorf("[socks4a] credentials are required, socks4 clients can not authenticate")
+	}
 
+	var requestedHost string
 	if c.req.addressType == domainname {
-		resolvedIP, err := currConfig.Resolv.Resolve(ctx, c.req.destHost)
+		requestedHost = c.req.destHost
+	}
+
+	if c.req.addressType == domainname && !c.passDomainToDialer() {
+		resolvedIPs, err := utils.ResolveIPs(ctx, c.h.config.Resolv, c.h.config.IPPolicy, c.req.destHost)
 		if err != nil {
-			return err
+			m.HandshakeRejected(metrics.VersionSocks4, "resolve_failed")
+			c.sendFailure(requestRejectedOrFailed)
+			return utils.NewRequestError("resolve", err)
 		}
+		c.destIPs = resolvedIPs
+		c.setDestIP(resolvedIPs[0])
+	}
+
+	if c.req.addressType != domainname {
+		c.sess.ResolvedDest = c.destAddr()
+	}
 
-		if ip4 := net.IP(resolvedIP).To4(); ip4 != nil {
-			c.req.addressType = ipv4
-			c.req.destHost = ip4.String()
-		} else {
-			c.req.addressType = ipv6
-			c.req.destHost = net.IP(resolvedIP).To16().String()
+	if !c.allowed(requestedHost) {
+		m.HandshakeRejected(metrics.VersionSocks4, "not_allowed")
+		c.sendFailure(requestRejectedOrFailed)
+		return utils.NewRequestError("rules", fmt.Errorf("[socks4a] request to (%s): %w", c.destAddr(), utils.ErrNotAllowed))
+	}
+
+	if kind, ok := c.req.cmd.limitKind(); ok {
+		release, err := c.h.config.SessionLimit.Acquire(kind, c.identity.Username, utils.IPFromAddr(c.conn.RemoteAddr()))
+		if err != nil {
+			m.HandshakeRejected(metrics.VersionSocks4, "limit_reached")
+			c.sendFailure(requestRejectedOrFailed)
+			return utils.NewRequestError("limit", err)
 		}
+		defer release()
 	}
 
 	switch c.req.cmd {
 	case connect:
+		m.HandshakeAccepted(metrics.VersionSocks4)
+		defer m.SessionStarted(metrics.VersionSocks4, c.req.cmd.String())()
 		return c.handleConnectCmd(ctx)
 	case bind:
+		m.HandshakeAccepted(metrics.VersionSocks4)
+		defer m.SessionStarted(metrics.VersionSocks4, c.req.cmd.String())()
 		return c.handleBindCmd(ctx)
 	default:
+		m.HandshakeRejected(metrics.VersionSocks4, "unsupported_command")
 		c.sendFailure(requestRejectedOrFailed)
 		return fmt.Errorf("unsupported command -> (%v) <-", c.req.cmd)
 	}
 }
 
+// destAddr is the destination of the request as host:port.
+func (c *client) destAddr() string {
+	return net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort)))
+}
+
+// setDestIP replaces the destination host of the request with ip.
+func (c *client) setDestIP(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		c.req.addressType = ipv4
+		c.req.destHost = ip4.String()
+	} else {
+		c.req.addressType = ipv6
+		c.req.destHost = ip.To16().String()
+	}
+}
+
+// passDomainToDialer reports whether the requested domain name should reach the dialer unresolved (remote dns),
+// only CONNECT can do that as the other commands need the destination IP.
+func (c *client) passDomainToDialer() bool {
+	return c.req.cmd == connect && c.h.config.RemoteDNS != nil && c.h.config.RemoteDNS(c.req.destHost)
+}
+
+// allowed evaluates the rules against the request, requestedHost is the domain name the client asked for (if any).
+// every address of a resolved CONNECT destination is checked, only the allowed ones are kept to be dialed.
+func (c *client) allowed(requestedHost string) bool {
+	req := &rules.Request{
+		ClientIP: utils.IPFromAddr(c.conn.RemoteAddr()),
+		User:     c.identity.Username,
+		DestHost: requestedHost,
+		DestIP:   net.ParseIP(c.req.destHost),
+		DestPort: c.req.destPort,
+	}
+	switch c.req.cmd {
+	case connect:
+		req.Command = rules.Connect
+	case bind:
+		req.Command = rules.Bind
+	default:
+		// unsupported commands are rejected later
+		return true
+	}
+	if req.Command != rules.Connect || len(c.destIPs) == 0 {
+		allowed, rule := c.h.config.Rules.Decide(req)
+		if rule != nil {
+			c.ruleName = rule.Name
+		}
+		return allowed
+	}
+	var allowedIPs []net.IP
+	for _, ip := range c.destIPs {
+		req.DestIP = ip
+		allowed, rule := c.h.config.Rules.Decide(req)
+		if !allowed {
+			continue
+		}
+		if len(allowedIPs) == 0 {
+			if rule != nil {
+				c.ruleName = rule.Name
+			}
+			c.setDestIP(ip)
+		}
+		allowedIPs = append(allowedIPs, ip)
+	}
+	c.destIPs = allowedIPs
+	return len(allowedIPs) > 0
+}
+
 func (c *client) handleConnectCmd(ctx context.Context) error {
 	// serverConn, err := net.DialTimeout("tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))), timeoutDuration)
-	serverConn, err := currConfig.Dial(ctx, "tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))))
+	serverConn, err := c.dial(ctx)
 	if err != nil {
+		// socks4 has a single failure code whatever the reason is
 		c.sendFailure(requestRejectedOrFailed)
-		return err
+		return utils.NewRequestError("dial", err)
 	}
 	defer serverConn.Close()
 
 	bindAddr, bindPortStr, _ := net.SplitHostPort(serverConn.LocalAddr().String())
 	bindPort, _ := strconv.Atoi(bindPortStr)
+	// the reply only fits an IPv4 address, an IPv6 destination (or upstream proxy) is connected from an unspecified one
+	if ip := net.ParseIP(bindAddr); ip == nil || ip.To4() == nil {
+		bindAddr = net.IPv4zero.String()
+	}
 
 	rep := &reply{resCode: requestGranted, bindAddr: bindAddr, bindPort: uint16(bindPort)}
 	buf, err := rep.marshal()
@@ -123,26 +291,23 @@ func (c *client) handleConnectCmd(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("could not write reply to the client")
 	}
+	c.sess.ReplyCode = int(requestGranted)
+	c.log.Debug("connected", "dest", serverConn.RemoteAddr(), "local", serverConn.LocalAddr())
 
-	errc := make(chan error, 2)
-
-	go func() {
-		_, err := io.Copy(serverConn, c.conn)
-		if err != nil {
-			err = fmt.Errorf("could not copy from client to server, %v", err)
-		}
-		errc <- err
-	}()
-
-	go func() {
-		_, err := io.Copy(c.conn, serverConn)
-		if err != nil {
-			err = fmt.Errorf("could not copy from server to client, %v", err)
-		}
-		errc <- err
-	}()
+	return c.relay(serverConn)
+}
 
-	return <-errc
+// dial connects to the destination, the addresses of a resolved domain name are raced (Happy Eyeballs).
+func (c *client) dial(ctx context.Context) (net.Conn, error) {
+	if len(c.destIPs) == 0 {
+		return c.h.config.Dial(ctx, "tcp", c.destAddr())
+	}
+	conn, addr, err := utils.DialHappyEyeballs(ctx, c.h.config.Dial, "tcp", c.destIPs, strconv.Itoa(int(c.req.destPort)), c.h.config.AttemptDelay)
+	if err != nil {
+		return nil, err
+	}
+	c.sess.ResolvedDest = addr
+	return conn, nil
 }
 
 func (c *client) handleBindCmd(ctx context.Context) error {
@@ -152,6 +317,9 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 		return err
 	}
 	defer listener.Close()
+	// the server may be closed while waiting for the incoming connection
+	stop := utils.CloseOnDone(ctx, listener)
+	defer stop()
 
 	_, bindPortStr, _ := net.SplitHostPort(listener.Addr().String())
 	bindPort, _ := strconv.Atoi(bindPortStr)
@@ -170,19 +338,23 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 		c.sendFailure(requestRejectedOrFailed)
 		return fmt.Errorf("could not write first reply to the client")
 	}
+	c.sess.ReplyCode = int(requestGranted)
+	c.log.Debug("bind listening", "addr", listener.Addr())
 
-	listener.SetDeadline(time.Now().Add(timeoutDuration))
+	listener.SetDeadline(time.Now().Add(c.h.config.BindTimeout))
 	bindConn, err := listener.Accept()
 	if err != nil {
 		c.sendFailure(requestRejectedOrFailed)
-		return err
+		return utils.NewRequestError("accept", err)
 	}
 	defer bindConn.Close()
 
+	// DSTIP is the address of the host expected to connect back, 0.0.0.0 accepts any peer.
 	connectedIP := bindConn.RemoteAddr().(*net.TCPAddr).IP
-	if !net.IP.IsUnspecified(connectedIP) && net.IP.Equal(net.ParseIP(c.req.destHost), connectedIP) {
+	expectedIP := net.ParseIP(c.req.destHost)
+	if expectedIP != nil && !expectedIP.IsUnspecified() && !expectedIP.Equal(connectedIP) {
 		c.sendFailure(requestRejectedOrFailed)
-		return fmt.Errorf("bind: mismatch is found")
+		return &utils.RequestError{Op: "bind", Kind: utils.KindNotAllowed, Err: fmt.Errorf("mismatch is found, expected (%v) but (%v) connected", expectedIP, connectedIP)}
 	}
 
 	// second reply
@@ -191,31 +363,26 @@ func (c *client) handleBindCmd(ctx context.Context) error {
 		c.sendFailure(requestRejectedOrFailed)
 		return fmt.Errorf("could not write second reply to the client")
 	}
+	c.sess.ReplyCode = int(requestGranted)
+	c.log.Debug("bind accepted", "peer", bindConn.RemoteAddr())
 
-	errc := make(chan error, 2)
-
-	go func() {
-		_, err := io.Copy(c.conn, bindConn)
-		if err != nil {
-			err = fmt.Errorf("could not copy from server to client, %v", err)
-		}
-		errc <- err
-	}()
-
-	go func() {
-		_, err := io.Copy(bindConn, c.conn)
-		if err != nil {
-			err = fmt.Errorf("could not copy from client to server, %v", err)
-		}
-		errc <- err
-	}()
+	return c.relay(bindConn)
+}
 
-	return <-errc
+// relay relays the client connection and conn until both directions are done.
+func (c *client) relay(conn net.Conn) error {
+	limits := c.h.config.RateLimit.Acquire(c.identity.Username, utils.IPFromAddr(c.conn.RemoteAddr()), c.ruleName)
+	defer limits.Release()
+	result := relay.Relay(limits.Conn(c.conn), conn, c.h.config.IdleTimeout)
+	c.h.config.Metrics.AddRelayed(metrics.VersionSocks4, result.Up, result.Down)
+	c.sess.AddBytes(result.Up, result.Down)
+	return result.Err()
 }
 
 func (c *client) sendFailure(code resultCode) error {
 	rep := &reply{resCode: code, bindAddr: "0.0.0.0", bindPort: 0}
 	buf, _ := rep.marshal()
+	c.sess.ReplyCode = int(code)
 	_, err := c.conn.Write(buf)
 	return err
 }
@@ -230,6 +397,7 @@ type request struct {
 	addressType addrType
 	destHost    string
 	destPort    uint16
+	userID      string
 }
 
 func parseRequest(conn net.Conn) (*request, error) {
@@ -239,6 +407,7 @@ func parseRequest(conn net.Conn) (*request, error) {
 		return nil, fmt.Errorf("could not read request header")
 	}
 	var oneByteBuf [1]byte
+	userID := make([]byte, 0, 8)
 	for {
 		_, err = io.ReadFull(conn, oneByteBuf[:])
 		if err != nil {
@@ -247,6 +416,7 @@ func parseRequest(conn net.Conn) (*request, error) {
 		if oneByteBuf[0] == 0 {
 			break
 		}
+		userID = append(userID, oneByteBuf[0])
 	}
 	cmd := command(buf[0])
 	destPort := binary.BigEndian.Uint16(buf[1:3])
@@ -270,7 +440,7 @@ func parseRequest(conn net.Conn) (*request, error) {
 		destHost = net.IP(buf[3:7]).String()
 		addressType = ipv4
 	}
-	return &request{cmd: cmd, addressType: addressType, destHost: destHost, destPort: destPort}, nil
+	return &request{cmd: cmd, addressType: addressType, destHost: destHost, destPort: destPort, userID: string(userID)}, nil
 }
 
 func isDomainUnresolved(ip []byte) bool {
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"fmt"
 	"io"
 )
@@ -21,7 +22,52 @@ const (
 type AuthMethod interface {
 	Code() byte
 	String() string
-	Handle(rw io.ReadWriter) error
+	// Handle runs the method specific subnegotiation and returns the identity of the authenticated client.
+	Handle(rw io.ReadWriter) (*Identity, error)
+}
+
+// Identity describes an authenticated client.
+type Identity struct {
+	// Username is empty for anonymous clients.
+	Username string
+	// Method is the name of the auth method that authenticated the client.
+	Method string
+	// Attributes holds method specific information about the client.
+	Attributes map[string]string
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx that carries id.
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity stored in ctx (if any).
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// CredentialsValidator is implemented by auth methods that check a username and a password,
+// it lets other protocols (such as the HTTP proxy) authenticate against the same credentials.
+type CredentialsValidator interface {
+	ValidateCredentials(username, password string) bool
+}
+
+// CredentialsRequired reports whether methods only accept clients that have credentials:
+// one of them is a CredentialsValidator and none of them is NoAuth.
+func CredentialsRequired(methods []AuthMethod) bool {
+	required := false
+	for _, method := range methods {
+		if method.Code() == NoAuthMethodRequiredCode {
+			return false
+		}
+		if _, ok := method.(CredentialsValidator); ok {
+			required = true
+		}
+	}
+	return required
 }
 
 func ValidateAuthMethods(methods []AuthMethod) error {
@@ -16,6 +16,6 @@ func (a *noAuth) String() string {
 	return "NO AUTHENTICATION REQUIRED"
 }
 
-func (a *noAuth) Handle(rw io.ReadWriter) error {
-	return nil
+func (a *noAuth) Handle(rw io.ReadWriter) (*Identity, error) {
+	return &Identity{Method: a.String()}, nil
 }
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt ($5$ and $6$) password hashing as specified in
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	shaCryptSaltMaxLen    = 16
+	shaCryptRoundsDefault = 5000
+	shaCryptRoundsMin     = 1000
+	shaCryptRoundsMax     = 999999999
+	shaCryptRoundsPrefix  = "rounds="
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var errInvalidSHACryptHash = errors.New("invalid sha-crypt hash")
+
+// byte order used when encoding the final digest (groups of 3 bytes)
+var (
+	sha256CryptOrder = [...][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [...][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// compareSHACrypt reports whether password matches the SHA-crypt hashed password.
+func compareSHACrypt(hashed, password string) bool {
+	computed, err := shaCrypt(hashed, password)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
+
+// shaCrypt hashes password using the id, rounds and salt found in setting ($5$[rounds=N$]salt[$hash]).
+func shaCrypt(setting, password string) (string, error) {
+	var newHash func() hash.Hash
+	var id string
+	switch {
+	case strings.HasPrefix(setting, "$5$"):
+		newHash, id = sha256.New, "$5$"
+	case strings.HasPrefix(setting, "$6$"):
+		newHash, id = sha512.New, "$6$"
+	default:
+		return "", errInvalidSHACryptHash
+	}
+	rest := setting[len(id):]
+
+	rounds := shaCryptRoundsDefault
+	customRounds := false
+	if strings.HasPrefix(rest, shaCryptRoundsPrefix) {
+		end := strings.IndexByte(rest, '$')
+		if end == -1 {
+			return "", errInvalidSHACryptHash
+		}
+		n, err := strconv.Atoi(rest[len(shaCryptRoundsPrefix):end])
+		if err != nil {
+			return "", errInvalidSHACryptHash
+		}
+		if n < shaCryptRoundsMin {
+			n = shaCryptRoundsMin
+		} else if n > shaCryptRoundsMax {
+			n = shaCryptRoundsMax
+		}
+		rounds, customRounds = n, true
+		rest = rest[end+1:]
+	}
+
+	salt := rest
+	if end := strings.IndexByte(salt, '$'); end != -1 {
+		salt = salt[:end]
+	}
+	if len(salt) > shaCryptSaltMaxLen {
+		salt = salt[:shaCryptSaltMaxLen]
+	}
+
+	key := []byte(password)
+	saltBytes := []byte(salt)
+
+	h := newHash()
+	h.Write(key)
+	h.Write(saltBytes)
+	h.Write(key)
+	alternate := h.Sum(nil)
+	size := len(alternate)
+
+	h.Reset()
+	h.Write(key)
+	h.Write(saltBytes)
+	i := len(key)
+	for ; i > size; i -= size {
+		h.Write(alternate)
+	}
+	h.Write(alternate[:i])
+	for i = len(key); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(alternate)
+		} else {
+			h.Write(key)
+		}
+	}
+	digest := h.Sum(nil)
+
+	h.Reset()
+	for i = 0; i < len(key); i++ {
+		h.Write(key)
+	}
+	p := repeatTo(h.Sum(nil), len(key))
+
+	h.Reset()
+	for i = 0; i < 16+int(digest[0]); i++ {
+		h.Write(saltBytes)
+	}
+	s := repeatTo(h.Sum(nil), len(saltBytes))
+
+	for r := 0; r < rounds; r++ {
+		h.Reset()
+		if r&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(digest)
+		}
+		if r%3 != 0 {
+			h.Write(s)
+		}
+		if r%7 != 0 {
+			h.Write(p)
+		}
+		if r&1 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(p)
+		}
+		digest = h.Sum(digest[:0])
+	}
+
+	var b strings.Builder
+	b.WriteString(id)
+	if customRounds {
+		b.WriteString(shaCryptRoundsPrefix)
+		b.WriteString(strconv.Itoa(rounds))
+		b.WriteByte('$')
+	}
+	b.WriteString(salt)
+	b.WriteByte('$')
+	if size == sha256.Size {
+		for _, g := range sha256CryptOrder {
+			encodeCrypt24(&b, digest[g[0]], digest[g[1]], digest[g[2]], 4)
+		}
+		encodeCrypt24(&b, 0, digest[31], digest[30], 3)
+	} else {
+		for _, g := range sha512CryptOrder {
+			encodeCrypt24(&b, digest[g[0]], digest[g[1]], digest[g[2]], 4)
+		}
+		encodeCrypt24(&b, 0, 0, digest[63], 2)
+	}
+	return b.String(), nil
+}
+
+// repeatTo returns b repeated (and truncated) to n bytes.
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out)+len(b) <= n {
+		out = append(out, b...)
+	}
+	return append(out, b[:n-len(out)]...)
+}
+
+func encodeCrypt24(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		b.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -21,17 +21,21 @@ var (
 var ErrAuthFailed = errors.New("auth failed: username or password is incorrect")
 
 type usernamePassword struct {
-	Username string
-	Password string
+	validator CredentialsValidator
 }
 
+// NewUsernamePassword accepts a single user.
 func NewUsernamePassword(username, password string) *usernamePassword {
 	return &usernamePassword{
-		Username: username,
-		Password: password,
+		validator: &singleUser{username: username, password: password},
 	}
 }
 
+// NewUsernamePasswordWithValidator accepts the users validator accepts (such as a *UserStore).
+func NewUsernamePasswordWithValidator(validator CredentialsValidator) *usernamePassword {
+	return &usernamePassword{validator: validator}
+}
+
 func (a *usernamePassword) Code() byte {
 	return UsernamePasswordCode
 }
@@ -40,36 +44,39 @@ func (a *usernamePassword) String() string {
 	return "USERNAME/PASSWORD"
 }
 
-func (a *usernamePassword) Handle(rw io.ReadWriter) error {
-	var buf [255]byte
+func (a *usernamePassword) Handle(rw io.ReadWriter) (*Identity, error) {
+	// big enough for the longest username (255 bytes) followed by PLEN
+	var buf [256]byte
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
-		return err
+		return nil, err
 	}
 
 	usernameLen := int(buf[1])
 
 	if _, err := io.ReadFull(rw, buf[:usernameLen+1]); err != nil {
-		return err
+		return nil, err
 	}
 
 	username := string(buf[:usernameLen])
 	passwordLen := int(buf[usernameLen])
 
 	if _, err := io.ReadFull(rw, buf[:passwordLen]); err != nil {
-		return err
+		return nil, err
 	}
 
 	password := string(buf[:passwordLen])
-	usernameCompResult := subtle.ConstantTimeCompare([]byte(username), []byte(a.Username))
-	passwordCompResult := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password))
 
-	if usernameCompResult != 1 || passwordCompResult != 1 {
+	if !a.ValidateCredentials(username, password) {
 		a.fail(rw)
-		return ErrAuthFailed
+		return nil, ErrAuthFailed
 	}
 
 	a.success(rw)
-	return nil
+	return &Identity{Username: username, Method: a.String()}, nil
+}
+
+func (a *usernamePassword) ValidateCredentials(username, password string) bool {
+	return a.validator.ValidateCredentials(username, password)
 }
 
 func (a *usernamePassword) success(w io.Writer) {
@@ -79,3 +86,14 @@ func (a *usernamePassword) success(w io.Writer) {
 func (a *usernamePassword) fail(w io.Writer) {
 	w.Write(failed[:])
 }
+
+type singleUser struct {
+	username string
+	password string
+}
+
+func (u *singleUser) ValidateCredentials(username, password string) bool {
+	usernameCompResult := subtle.ConstantTimeCompare([]byte(username), []byte(u.username))
+	passwordCompResult := subtle.ConstantTimeCompare([]byte(password), []byte(u.password))
+	return usernameCompResult == 1 && passwordCompResult == 1
+}
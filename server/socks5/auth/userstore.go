@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserStore is a set of users loaded from a file, it can be reloaded at runtime
+// without affecting already authenticated sessions.
+//
+// every non empty line (that is not a comment starting with '#') has the form
+//
+//	[!]username:password
+//
+// where a leading '!' disables the user and password is either
+// a bcrypt hash ($2a$, $2b$, $2y$), a SHA-crypt hash ($5$, $6$) or a plaintext password.
+type UserStore struct {
+	path string
+
+	mu      sync.RWMutex
+	users   map[string]storedUser
+	modTime time.Time
+	size    int64
+}
+
+type storedUser struct {
+	password string
+	disabled bool
+}
+
+// LoadUserStore reads the users file found at path.
+func LoadUserStore(path string) (*UserStore, error) {
+	s := &UserStore{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the users file, the current users are kept if the file is invalid.
+func (s *UserStore) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseUsersFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.users = users
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch checks the users file every interval and reloads it when it changes,
+// onReload (if not nil) is called after every reload attempt. Calling the returned function stops watching.
+func (s *UserStore) Watch(interval time.Duration, onReload func(error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(s.path)
+			if err != nil {
+				continue
+			}
+			s.mu.RLock()
+			changed := !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+			s.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			err = s.Reload()
+			if onReload != nil {
+				onReload(err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Len returns the number of users (enabled and disabled).
+func (s *UserStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+func (s *UserStore) ValidateCredentials(username, password string) bool {
+	s.mu.RLock()
+	u, ok := s.users[username]
+	s.mu.RUnlock()
+	if !ok || u.disabled {
+		return false
+	}
+	return comparePassword(u.password, password)
+}
+
+// comparePassword reports whether password matches stored which is either a hash or a plaintext password.
+func comparePassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "$5$"), strings.HasPrefix(stored, "$6$"):
+		return compareSHACrypt(stored, password)
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+func parseUsersFile(path string) (map[string]storedUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]storedUser)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var u storedUser
+		if strings.HasPrefix(line, "!") {
+			u.disabled = true
+			line = line[1:]
+		}
+		username, password, found := strings.Cut(line, ":")
+		if !found || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'username:password'", path, lineNumber)
+		}
+		if _, exists := users[username]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate user (%s)", path, lineNumber, username)
+		}
+		u.password = password
+		users[username] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
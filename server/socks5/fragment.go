@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"bytes"
+	"time"
+)
+
+// the high-order bit of FRAG marks the last fragment of a sequence, the other bits are its position (1 to 127).
+const (
+	fragEndOfSequence byte = 0x80
+	fragPositionMask  byte = 0x7f
+)
+
+// minReassemblyTimeout is the shortest reassembly timer rfc 1928 allows.
+const minReassemblyTimeout = 5 * time.Second
+
+// reassembler is the reassembly queue of a UDP association (rfc 1928 section 7).
+// fragments must arrive in order (positions 1, 2, ...) with the same destination, otherwise the sequence is dropped,
+// so is a sequence that is not complete before the reassembly timer expires or that grows beyond maxSize.
+type reassembler struct {
+	timeout time.Duration
+	maxSize int
+
+	// next is the position expected for the next fragment, 0 if no sequence is in progress.
+	next     byte
+	header   []byte // the address part (ATYP, DST.ADDR and DST.PORT) of the first fragment
+	req      *udpAssociateRequest
+	data     []byte
+	deadline time.Time
+}
+
+func newReassembler(timeout time.Duration, maxSize int) *reassembler {
+	if timeout < minReassemblyTimeout {
+		timeout = minReassemblyTimeout
+	}
+	return &reassembler{timeout: timeout, maxSize: maxSize}
+}
+
+// add queues the fragment datagram (whose request is req) and returns the reassembled request and payload once the sequence is complete.
+// dropped is the reason the fragment (or the queued sequence) was dropped, if any.
+func (r *reassembler) add(req *udpAssociateRequest, datagram []byte, now time.Time) (complete *udpAssociateRequest, payload []byte, dropped string) {
+	if r.next != 0 && now.After(r.deadline) {
+		r.reset()
+		dropped = "reassembly_timeout"
+	}
+	position := req.fragmentNumber & fragPositionMask
+	header := datagram[3:req.payloadIndex]
+	fragment := datagram[req.payloadIndex:]
+
+	if position == 1 {
+		if r.next != 0 {
+			// a new sequence replaces the incomplete one
+			dropped = "fragment_out_of_order"
+		}
+		r.reset()
+		r.next = 1
+		r.header = append(r.header[:0], header...)
+		r.req = req
+		r.deadline = now.Add(r.timeout)
+	} else if position == 0 || position != r.next || !bytes.Equal(header, r.header) {
+		if r.next != 0 {
+			r.reset()
+		}
+		if dropped == "" {
+			dropped = "fragment_out_of_order"
+		}
+		return nil, nil, dropped
+	}
+
+	if len(r.data)+len(fragment) > r.maxSize {
+		r.reset()
+		return nil, nil, "fragment_oversized"
+	}
+	r.data = append(r.data, fragment...)
+	r.next++
+
+	if req.fragmentNumber&fragEndOfSequence != 0 {
+		complete, payload = r.req, r.data
+		// the payload is handed out, the next sequence uses a new buffer
+		r.data = nil
+		r.reset()
+		return complete, payload, dropped
+	}
+	if r.next > fragPositionMask {
+		// no room for the end of the sequence
+		r.reset()
+		return nil, nil, "fragment_out_of_order"
+	}
+	return nil, nil, dropped
+}
+
+// timerDeadline returns when the reassembly timer of the sequence in progress expires, zero if there is none.
+func (r *reassembler) timerDeadline() time.Time {
+	if r.next == 0 {
+		return time.Time{}
+	}
+	return r.deadline
+}
+
+// expire drops the sequence in progress if its reassembly timer expired by now (its buffer is released as well),
+// the reader of the datagrams calls it when no fragment arrives before the deadline.
+func (r *reassembler) expire(now time.Time) bool {
+	if r.next == 0 || !now.After(r.deadline) {
+		return false
+	}
+	r.reset()
+	r.data = nil
+	return true
+}
+
+func (r *reassembler) reset() {
+	r.next = 0
+	r.req = nil
+	r.data = r.data[:0]
+}
@@ -10,7 +10,13 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/OmarTariq612/socks-server/connlimit"
+	"github.com/OmarTariq612/socks-server/logging"
+	"github.com/OmarTariq612/socks-server/metrics"
+	"github.com/OmarTariq612/socks-server/relay"
+	"github.com/OmarTariq612/socks-server/rules"
 	"github.com/OmarTariq612/socks-server/server/socks5/auth"
+	"github.com/OmarTariq612/socks-server/session"
 	"github.com/OmarTariq612/socks-server/utils"
 )
 
@@ -18,6 +24,33 @@ const socksServerVersion byte = 5
 
 type command byte
 
+func (c command) String() string {
+	switch c {
+	case connect:
+		return "connect"
+	case bind:
+		return "bind"
+	case udpAssociate:
+		return "udp associate"
+	default:
+		return strconv.Itoa(int(c))
+	}
+}
+
+// limitKind is the kind of session counted by the session limits for the command.
+func (c command) limitKind() (connlimit.Kind, bool) {
+	switch c {
+	case connect:
+		return connlimit.TCP, true
+	case bind:
+		return connlimit.Bind, true
+	case udpAssociate:
+		return connlimit.UDP, true
+	default:
+		return 0, false
+	}
+}
+
 const (
 	connect      command = 1
 	bind         command = 2
@@ -48,71 +81,128 @@ const (
 
 const timeoutDuration time.Duration = 5 * time.Second
 
-var currConfig struct {
-	c           *utils.Config
+// maxUDPPayload is the largest payload of a UDP datagram over IPv4.
+const maxUDPPayload = math.MaxUint16 - 28 // 28 = [20-byte IP header] + [8-byte UDP header]
+
+// Handler serves socks5 connections, every SocksServer has its own.
+type Handler struct {
+	config      *utils.Config
 	authMethods []auth.AuthMethod
 }
 
-func InitConfig(config *utils.Config, methods []auth.AuthMethod) error {
-	currConfig.c = config
+// NewHandler returns a Handler accepting the given auth methods (no authentication if none is given).
+func NewHandler(config *utils.Config, methods []auth.AuthMethod) (*Handler, error) {
 	if len(methods) == 0 {
-		methods = append(methods, auth.NoAuth())
+		methods = []auth.AuthMethod{auth.NoAuth()}
 	}
 	if err := auth.ValidateAuthMethods(methods); err != nil {
-		return err
+		return nil, err
 	}
-	currConfig.authMethods = methods
-	return nil
+	return &Handler{config: config, authMethods: methods}, nil
 }
 
-func HandleConnection(conn net.Conn) error {
-	c := newClient(conn)
-	return c.handle()
+// HandleConnection serves conn whose version byte is already consumed.
+func (h *Handler) HandleConnection(ctx context.Context, conn net.Conn) error {
+	c := newClient(h, conn)
+	return c.handle(ctx)
 }
 
 type client struct {
-	conn net.Conn
-	req  *request
+	h        *Handler
+	conn     net.Conn
+	req      *request
+	identity *auth.Identity
+	sess     *session.Session
+	log      logging.Logger
+	// ruleName is the name of the rule that allowed the request (empty if none), used for per rule limits.
+	ruleName string
+	// destIPs are the addresses of a resolved domain name destination in the order they are dialed.
+	destIPs []net.IP
 }
 
-func newClient(conn net.Conn) *client {
-	return &client{conn: conn}
+func newClient(h *Handler, conn net.Conn) *client {
+	return &client{h: h, conn: conn}
 }
 
-func (c *client) handle() error {
-	authMethodIndex, err := handleHandshake(c.conn)
+func (c *client) handle(ctx context.Context) error {
+	c.sess = session.FromContext(ctx)
+	c.log = logging.With(c.h.config.Logger, "session", c.sess.ID)
+	m := c.h.config.Metrics
+	authMethodIndex, err := handleHandshake(c.conn, c.h.authMethods)
 	if err != nil {
+		m.HandshakeRejected(metrics.VersionSocks5, "no_acceptable_method")
 		c.conn.Write([]byte{socksServerVersion, auth.NoAcceptableMethodCode})
 		return err
 	}
-	_, err = c.conn.Write([]byte{socksServerVersion, currConfig.authMethods[authMethodIndex].Code()})
+	c.sess.AuthMethod = c.h.authMethods[authMethodIndex].String()
+	_, err = c.conn.Write([]byte{socksServerVersion, c.h.authMethods[authMethodIndex].Code()})
 	if err != nil {
 		return fmt.Errorf("could not reply to the handshake")
 	}
-	if err := currConfig.authMethods[authMethodIndex].Handle(c.conn); err != nil {
+	identity, err := c.h.authMethods[authMethodIndex].Handle(c.conn)
+	if err != nil {
+		m.AuthFailed(c.h.authMethods[authMethodIndex].String())
+		m.HandshakeRejected(metrics.VersionSocks5, "auth_failed")
 		return err
 	}
+	c.identity = identity
+	c.sess.AuthMethod = identity.Method
+	c.sess.User = identity.Username
+	ctx = auth.NewContext(ctx, identity)
 	req, err := parseRequest(c.conn)
 	if err != nil {
+		m.HandshakeRejected(metrics.VersionSocks5, "bad_request")
 		c.sendFailure(generalSocksFailure)
 		return err
 	}
 	c.req = req
-	ctx := context.Background()
+	// the handshake timeout (set by the server) only covers reading the request
+	c.conn.SetDeadline(time.Time{})
+	c.sess.Command = req.cmd.String()
+	c.sess.RequestedDest = c.destAddr()
+	c.log.Debug("socks5 request", "command", req.cmd, "dest", c.sess.RequestedDest, "user", identity.Username, "auth_method", identity.Method)
 
+	var requestedHost string
 	if c.req.addressType == domainname {
-		resolvedIP, err := currConfig.c.Resolv.Resolve(ctx, c.req.destHost)
+		requestedHost = c.req.destHost
+	}
+
+	if c.req.addressType == domainname && !c.passDomainToDialer() {
+		resolvedIPs, err := utils.ResolveIPs(ctx, c.h.config.Resolv, c.h.config.IPPolicy, c.req.destHost)
 		if err != nil {
-			return err
+			reqErr := utils.NewRequestError("resolve", err)
+			m.HandshakeRejected(metrics.VersionSocks5, "resolve_failed")
+			c.sendFailure(resultCodeFor(reqErr.Kind))
+			return reqErr
 		}
+		c.destIPs = resolvedIPs
+		c.setDestIP(resolvedIPs[0])
+	}
 
-		if ip4 := net.IP(resolvedIP).To4(); ip4 != nil {
-			c.req.addressType = ipv4
-			c.req.destHost = ip4.String()
-		} else {
-			c.req.addressType = ipv6
-			c.req.destHost = net.IP(resolvedIP).To16().String()
+	if c.req.addressType != domainname {
+		c.sess.ResolvedDest = c.destAddr()
+	}
+
+	if !c.allowed(requestedHost) {
+		m.HandshakeRejected(metrics.VersionSocks5, "not_allowed")
+		c.sendFailure(connectionNotAllowed)
+		return utils.NewRequestError("rules", fmt.Errorf("[socks5] %v request to (%s): %w", c.req.cmd, c.destAddr(), utils.ErrNotAllowed))
+	}
+
+	if kind, ok := c.req.cmd.limitKind(); ok {
+		release, err := c.h.config.SessionLimit.Acquire(kind, c.identity.Username, utils.IPFromAddr(c.conn.RemoteAddr()))
+		if err != nil {
+			m.HandshakeRejected(metrics.VersionSocks5, "limit_reached")
+			c.sendFailure(connectionNotAllowed)
+			return utils.NewRequestError("limit", err)
 		}
+		defer release()
+	}
+
+	switch c.req.cmd {
+	case connect, bind, udpAssociate:
+		m.HandshakeAccepted(metrics.VersionSocks5)
+		defer m.SessionStarted(metrics.VersionSocks5, c.req.cmd.String())()
 	}
 
 	switch c.req.cmd {
@@ -123,34 +213,90 @@ func (c *client) handle() error {
 	case udpAssociate:
 		return c.handleUDPAssociateCmd(ctx)
 	default:
+		m.HandshakeRejected(metrics.VersionSocks5, "unsupported_command")
 		c.sendFailure(commandNotSupported)
 		return fmt.Errorf("invalid command -> (%v) <-", c.req.cmd)
 	}
 }
 
+// destAddr is the destination of the request as host:port.
+func (c *client) destAddr() string {
+	return net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort)))
+}
+
+// setDestIP replaces the destination host of the request with ip.
+func (c *client) setDestIP(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		c.req.addressType = ipv4
+		c.req.destHost = ip4.String()
+	} else {
+		c.req.addressType = ipv6
+		c.req.destHost = ip.To16().String()
+	}
+}
+
+// passDomainToDialer reports whether the requested domain name should reach the dialer unresolved (remote dns),
+// only CONNECT can do that as the other commands need the destination IP.
+func (c *client) passDomainToDialer() bool {
+	return c.req.cmd == connect && c.h.config.RemoteDNS != nil && c.h.config.RemoteDNS(c.req.destHost)
+}
+
+// allowed evaluates the rules against the request, requestedHost is the domain name the client asked for (if any).
+// a UDP association is allowed if any destination could be, its datagrams are checked one by one.
+// every address of a resolved CONNECT destination is checked, only the allowed ones are kept to be dialed.
+func (c *client) allowed(requestedHost string) bool {
+	req := &rules.Request{
+		ClientIP: utils.IPFromAddr(c.conn.RemoteAddr()),
+		User:     c.identity.Username,
+		DestHost: requestedHost,
+		DestIP:   net.ParseIP(c.req.destHost),
+		DestPort: c.req.destPort,
+	}
+	switch c.req.cmd {
+	case connect:
+		req.Command = rules.Connect
+	case bind:
+		req.Command = rules.Bind
+	case udpAssociate:
+		req.Command = rules.UDPAssociate
+		return c.h.config.Rules.AllowAny(req)
+	default:
+		// unsupported commands are rejected later
+		return true
+	}
+	if req.Command != rules.Connect || len(c.destIPs) == 0 {
+		allowed, rule := c.h.config.Rules.Decide(req)
+		c.ruleName = ruleNameOf(rule)
+		return allowed
+	}
+	var allowedIPs []net.IP
+	for _, ip := range c.destIPs {
+		req.DestIP = ip
+		allowed, rule := c.h.config.Rules.Decide(req)
+		if !allowed {
+			continue
+		}
+		if len(allowedIPs) == 0 {
+			c.ruleName = ruleNameOf(rule)
+			c.setDestIP(ip)
+		}
+		allowedIPs = append(allowedIPs, ip)
+	}
+	c.destIPs = allowedIPs
+	return len(allowedIPs) > 0
+}
+
 func (c *client) handleConnectCmd(ctx context.Context) error {
 	// serverConn, err := net.DialTimeout("tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))), timeoutDuration)
-	serverConn, err := currConfig.c.Dial(ctx, "tcp", net.JoinHostPort(c.req.destHost, strconv.Itoa(int(c.req.destPort))))
+	serverConn, err := c.dial(ctx)
 	if err != nil {
-		c.sendFailure(generalSocksFailure)
-		return err
+		reqErr := utils.NewRequestError("dial", err)
+		c.sendFailure(resultCodeFor(reqErr.Kind))
+		return reqErr
 	}
 	defer serverConn.Close()
 
-	bindAddr, bindPortStr, _ := net.SplitHostPort(serverConn.LocalAddr().String())
-	var addressType addrType
-	if ip := net.ParseIP(bindAddr); ip != nil {
-		if ip.To4() != nil {
-			addressType = ipv4
-		} else {
-			addressType = ipv6
-		}
-	} else {
-		addressType = domainname
-	}
-	bindPort, _ := strconv.Atoi(bindPortStr)
-
-	rep := &reply{resCode: succeeded, addressType: addressType, bindAddr: bindAddr, bindPort: uint16(bindPort)}
+	rep := newReplyFromAddr(succeeded, serverConn.LocalAddr())
 	buf, err := rep.marshal()
 	if err != nil {
 		c.sendFailure(generalSocksFailure)
@@ -161,179 +307,142 @@ func (c *client) handleConnectCmd(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	c.sess.ReplyCode = int(succeeded)
+	c.log.Debug("connected", "dest", serverConn.RemoteAddr(), "local", serverConn.LocalAddr())
 
-	errc := make(chan error, 2)
-
-	go func() {
-		_, err := io.Copy(serverConn, c.conn)
-		if err != nil {
-			err = fmt.Errorf("could not copy from client to server, %v", err)
-		}
-		errc <- err
-	}()
-
-	go func() {
-		_, err := io.Copy(c.conn, serverConn)
-		if err != nil {
-			err = fmt.Errorf("could not copy from server to client, %v", err)
-		}
-		errc <- err
-	}()
+	return c.relay(serverConn)
+}
 
-	return <-errc
+// dial connects to the destination, the addresses of a resolved domain name are raced (Happy Eyeballs).
+func (c *client) dial(ctx context.Context) (net.Conn, error) {
+	if len(c.destIPs) == 0 {
+		return c.h.config.Dial(ctx, "tcp", c.destAddr())
+	}
+	conn, addr, err := utils.DialHappyEyeballs(ctx, c.h.config.Dial, "tcp", c.destIPs, strconv.Itoa(int(c.req.destPort)), c.h.config.AttemptDelay)
+	if err != nil {
+		return nil, err
+	}
+	c.sess.ResolvedDest = addr
+	return conn, nil
 }
 
-func (c *client) handleBindCmd(ctx context.Context) error {
-	// TODO: support bind command
-	c.sendFailure(commandNotSupported)
-	return fmt.Errorf("[socks5] bind cmd is not supported")
+// relay relays the client connection and conn until both directions are done.
+func (c *client) relay(conn net.Conn) error {
+	limits := c.h.config.RateLimit.Acquire(c.identity.Username, utils.IPFromAddr(c.conn.RemoteAddr()), c.ruleName)
+	defer limits.Release()
+	result := relay.Relay(limits.Conn(c.conn), conn, c.h.config.IdleTimeout)
+	c.h.config.Metrics.AddRelayed(metrics.VersionSocks5, result.Up, result.Down)
+	c.sess.AddBytes(result.Up, result.Down)
+	return result.Err()
 }
 
-func (c *client) handleUDPAssociateCmd(ctx context.Context) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", "")
-	if err != nil {
+func (c *client) handleBindCmd(ctx context.Context) error {
+	// listen on the same address (and family) the client used to reach us,
+	// so the address in the first reply is reachable by the application server.
+	localIP := utils.IPFromAddr(c.conn.LocalAddr())
+	if localIP == nil {
+		// such as a unix socket listener, there is no address the application server could reach
 		c.sendFailure(generalSocksFailure)
-		return err
+		return fmt.Errorf("bind needs a TCP control connection -> (%v) <-", c.conn.LocalAddr())
+	}
+	network := "tcp6"
+	if localIP.To4() != nil {
+		network = "tcp4"
 	}
-	// TODO: support IPv6
-	udpRelaySrv, err := net.ListenUDP("udp4", udpAddr)
+	listener, err := net.ListenTCP(network, &net.TCPAddr{IP: localIP})
 	if err != nil {
-
 		c.sendFailure(generalSocksFailure)
 		return err
 	}
-	defer udpRelaySrv.Close()
+	defer listener.Close()
+	// the server may be closed while waiting for the incoming connection
+	stop := utils.CloseOnDone(ctx, listener)
+	defer stop()
 
-	bindAddr, bindPortStr, _ := net.SplitHostPort(udpRelaySrv.LocalAddr().String())
-	bindPort, _ := strconv.Atoi(bindPortStr)
-	rep := &reply{resCode: succeeded, addressType: ipv4, bindAddr: bindAddr, bindPort: uint16(bindPort)}
-	replyBuf, err := rep.marshal()
+	// first reply
+	rep := newReplyFromAddr(succeeded, listener.Addr())
+	buf, err := rep.marshal()
 	if err != nil {
 		c.sendFailure(generalSocksFailure)
 		return err
 	}
-	_, err = c.conn.Write(replyBuf)
+	_, err = c.conn.Write(buf)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not write first reply to the client")
 	}
+	c.sess.ReplyCode = int(succeeded)
+	c.log.Debug("bind listening", "addr", listener.Addr())
 
-	go func() {
-		var buf [1]byte
-		for {
-			_, err := c.conn.Read(buf[:])
-			if err != nil {
-				udpRelaySrv.Close()
-				break
-			}
-		}
-	}()
-
-	const maxBufSize = math.MaxUint16 - 28 // 28 = [20-byte IP header] + [8-byte UDP header]
-	var buf [maxBufSize]byte
-	firstReceive := true
-	associatedAddr := c.conn.RemoteAddr().(*net.TCPAddr)
-	var associatedUDPAddr *net.UDPAddr
-
-	for {
-		n, senderAddr, err := udpRelaySrv.ReadFromUDP(buf[:])
-		if err != nil {
-			return err
-		}
-
-		if firstReceive {
-			if !net.IP.Equal(senderAddr.IP, associatedAddr.IP) {
-				continue
-			}
-			firstReceive = false
-			associatedUDPAddr = senderAddr
-		}
+	listener.SetDeadline(time.Now().Add(c.h.config.BindTimeout))
+	bindConn, err := listener.Accept()
+	if err != nil {
+		reqErr := utils.NewRequestError("accept", err)
+		c.sendFailure(resultCodeFor(reqErr.Kind))
+		return reqErr
+	}
+	defer bindConn.Close()
+
+	// DST.ADDR is the address of the host expected to connect back,
+	// an unspecified address (0.0.0.0 or ::) accepts any peer.
+	connectedIP := bindConn.RemoteAddr().(*net.TCPAddr).IP
+	expectedIP := net.ParseIP(c.req.destHost)
+	if expectedIP != nil && !expectedIP.IsUnspecified() && !expectedIP.Equal(connectedIP) {
+		c.sendFailure(connectionNotAllowed)
+		return &utils.RequestError{Op: "bind", Kind: utils.KindNotAllowed, Err: fmt.Errorf("mismatch is found, expected (%v) but (%v) connected", expectedIP, connectedIP)}
+	}
 
-		if net.IP.Equal(senderAddr.IP, associatedAddr.IP) {
-			req, err := parseUDPAssociateRequest(buf[:n])
-			if err != nil {
-				return err
-			}
-			_, err = udpRelaySrv.WriteToUDP(buf[req.payloadIndex:n], req.destAddr)
-			if err != nil {
-				return err
-			}
-		} else {
-			packet, err := udpAssociateReply(senderAddr, buf[:n])
-			if err != nil {
-				return err
-			}
-			_, err = udpRelaySrv.WriteToUDP(packet, associatedUDPAddr)
-			if err != nil {
-				return err
-			}
-		}
+	// second reply
+	rep = newReplyFromAddr(succeeded, bindConn.RemoteAddr())
+	buf, err = rep.marshal()
+	if err != nil {
+		c.sendFailure(generalSocksFailure)
+		return err
 	}
-}
+	_, err = c.conn.Write(buf)
+	if err != nil {
+		return fmt.Errorf("could not write second reply to the client")
+	}
+	c.sess.ReplyCode = int(succeeded)
+	c.log.Debug("bind accepted", "peer", bindConn.RemoteAddr())
 
-type udpAssociateRequest struct {
-	fragmentNumber byte
-	addressType    addrType
-	destAddr       *net.UDPAddr
-	payloadIndex   int
+	return c.relay(bindConn)
 }
 
-func parseUDPAssociateRequest(b []byte) (*udpAssociateRequest, error) {
-	fragmentNumber := b[2]
-	addressType := addrType(b[3])
-	var payloadIndex int
-	var host string
-	switch addressType {
-	case ipv4:
-		host = net.IP(b[4:8]).String()
-		payloadIndex = 10
-	case domainname:
-		length := int(b[4])
-		host = string(b[5 : length+5])
-		payloadIndex = length + 7
-	case ipv6:
-		host = net.IP(b[4:20]).String()
-		payloadIndex = 22
-	default:
-		return nil, fmt.Errorf("invalid address type code -> (%v) <-", addressType)
-	}
-	portIndex := payloadIndex - 2
-	port := binary.BigEndian.Uint16(b[portIndex : portIndex+2])
-	destAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
-	if err != nil {
-		return nil, fmt.Errorf("invalid destination in the udp associate request")
+func ruleNameOf(rule *rules.Rule) string {
+	if rule == nil {
+		return ""
 	}
-	return &udpAssociateRequest{fragmentNumber: fragmentNumber, addressType: addressType, destAddr: destAddr, payloadIndex: payloadIndex}, nil
+	return rule.Name
 }
 
-func udpAssociateReply(addr *net.UDPAddr, payload []byte) ([]byte, error) {
-	var addrLength int
-	var addressType addrType
-	if ip := addr.IP.To4(); ip != nil {
-		addrLength = 4
-		addressType = ipv4
-	} else {
-		addrLength = 16
-		addressType = ipv6
-	}
-	var port [2]byte
-	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
-	packet := make([]byte, 0, 4+addrLength+2+len(payload))
-	packet = append(packet, 0, 0, 0, byte(addressType))
-	packet = append(packet, addr.IP...)
-	packet = append(packet, port[:]...)
-	packet = append(packet, payload...)
-	return packet, nil
+// resultCodeFor maps the classification of a failed request to its reply code.
+func resultCodeFor(kind utils.ErrorKind) resultCode {
+	switch kind {
+	case utils.KindNotAllowed:
+		return connectionNotAllowed
+	case utils.KindNetworkUnreachable:
+		return networkUnreachable
+	case utils.KindHostUnreachable:
+		return hostUnreachable
+	case utils.KindConnectionRefused:
+		return connectionRefused
+	case utils.KindTimeout:
+		return ttlExpired
+	default:
+		return generalSocksFailure
+	}
 }
 
 func (c *client) sendFailure(code resultCode) error {
 	// rep := &reply{resCode: code}
 	rep := &reply{resCode: code, addressType: ipv4, bindAddr: "0.0.0.0", bindPort: 0}
 	buf, _ := rep.marshal()
+	c.sess.ReplyCode = int(code)
 	_, err := c.conn.Write(buf)
 	return err
 }
 
-func handleHandshake(conn net.Conn) (authMethodIndex int, err error) {
+func handleHandshake(conn net.Conn, acceptedAuthMethods []auth.AuthMethod) (authMethodIndex int, err error) {
 	var nAuthMethods [1]byte
 	_, err = io.ReadFull(conn, nAuthMethods[:])
 	if err != nil {
@@ -345,7 +454,7 @@ func handleHandshake(conn net.Conn) (authMethodIndex int, err error) {
 		return -1, fmt.Errorf("could not read the list of auth methods (handshake)")
 	}
 	for _, method := range authMethods {
-		for i, acceptedAuthMethod := range currConfig.authMethods {
+		for i, acceptedAuthMethod := range acceptedAuthMethods {
 			if method == acceptedAuthMethod.Code() {
 				return i, nil
 			}
@@ -426,6 +535,23 @@ type reply struct {
 	bindPort    uint16
 }
 
+// newReplyFromAddr builds a reply whose BND.ADDR and BND.PORT are taken from addr.
+func newReplyFromAddr(code resultCode, addr net.Addr) *reply {
+	host, portStr, _ := net.SplitHostPort(addr.String())
+	port, _ := strconv.Atoi(portStr)
+	var addressType addrType
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			addressType = ipv4
+		} else {
+			addressType = ipv6
+		}
+	} else {
+		addressType = domainname
+	}
+	return &reply{resCode: code, addressType: addressType, bindAddr: host, bindPort: uint16(port)}
+}
+
 func (r *reply) marshal() ([]byte, error) {
 	buf := []byte{
 		socksServerVersion,
@@ -0,0 +1,431 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OmarTariq612/socks-server/ratelimit"
+	"github.com/OmarTariq612/socks-server/rules"
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+// udpResolveTTL is how long a UDP association keeps using the IP a domain name destination resolved to.
+const udpResolveTTL = time.Minute
+
+// maxUDPResolved bounds the resolved domain names an association keeps.
+const maxUDPResolved = 256
+
+// udpAssociation relays the datagrams of a UDP ASSOCIATE request. the client talks to relayConn, which is bound to
+// the local IP of the control connection, while the destinations are reached through a socket per address family
+// (opened by Config.ListenPacket), so both IPv4 and IPv6 destinations are reachable whatever family the client uses.
+type udpAssociation struct {
+	down int64 // bytes relayed to the client (atomic, kept first for its alignment)
+
+	// ctx carries the identity of the client to the resolver and ListenPacket.
+	ctx       context.Context
+	c         *client
+	relayConn *net.UDPConn
+	limits    *ratelimit.Session
+	idle      *utils.IdleTimer
+	closed    int32 // set (atomically) once the association is ended on purpose
+
+	// clientAddr is set by the read loop before any outbound socket exists and never changes after that,
+	// so the reply relays can read it without locking.
+	clientAddr *net.UDPAddr
+	outbound   map[string]net.PacketConn // by network (udp4 or udp6), only used by the read loop
+	replies    sync.WaitGroup
+	// resolved caches the domain name destinations, only used by the read loop.
+	resolved map[string]resolvedIP
+}
+
+type resolvedIP struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func (c *client) handleUDPAssociateCmd(ctx context.Context) error {
+	// listen on the same address (and family) the client used to reach us, as BIND does.
+	localAddr, ok := c.conn.LocalAddr().(*net.TCPAddr)
+	if !ok || utils.IPFromAddr(c.conn.RemoteAddr()) == nil {
+		// such as a unix socket listener, the datagrams of the client could not be told apart from the others
+		c.sendFailure(generalSocksFailure)
+		return fmt.Errorf("udp associate needs a TCP control connection -> (%v) <-", c.conn.LocalAddr())
+	}
+	limits := c.h.config.RateLimit.Acquire(c.identity.Username, utils.IPFromAddr(c.conn.RemoteAddr()), "")
+	defer limits.Release()
+
+	network := "udp6"
+	if localAddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	relayConn, err := net.ListenUDP(network, &net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone})
+	if err != nil {
+		c.sendFailure(generalSocksFailure)
+		return err
+	}
+	a := &udpAssociation{
+		ctx:       ctx,
+		c:         c,
+		relayConn: relayConn,
+		limits:    limits,
+		outbound:  make(map[string]net.PacketConn),
+		resolved:  make(map[string]resolvedIP),
+	}
+	defer a.end()
+	stop := utils.CloseOnDone(ctx, a)
+	defer stop()
+
+	rep := newReplyFromAddr(succeeded, relayConn.LocalAddr())
+	replyBuf, err := rep.marshal()
+	if err != nil {
+		c.sendFailure(generalSocksFailure)
+		return err
+	}
+	_, err = c.conn.Write(replyBuf)
+	if err != nil {
+		return err
+	}
+	c.sess.ReplyCode = int(succeeded)
+	c.log.Debug("udp association", "relay", relayConn.LocalAddr())
+
+	// the association lives as long as the control connection
+	go func() {
+		var buf [1]byte
+		for {
+			_, err := c.conn.Read(buf[:])
+			if err != nil {
+				a.Close()
+				break
+			}
+		}
+	}()
+
+	a.idle = utils.NewIdleTimer(c.h.config.UDPIdleTimeout, func() { a.Close() })
+	defer a.idle.Stop()
+
+	return a.run()
+}
+
+// Close ends the association, the read loop returns without an error.
+func (a *udpAssociation) Close() error {
+	atomic.StoreInt32(&a.closed, 1)
+	return a.relayConn.Close()
+}
+
+func (a *udpAssociation) isClosed() bool {
+	return atomic.LoadInt32(&a.closed) != 0
+}
+
+// end closes every socket of the association, waits for the reply relays and counts the bytes they relayed.
+func (a *udpAssociation) end() {
+	a.Close()
+	for _, conn := range a.outbound {
+		conn.Close()
+	}
+	a.replies.Wait()
+	a.c.sess.AddBytes(0, atomic.LoadInt64(&a.down))
+}
+
+// run relays the datagrams of the client to their destinations until the association ends.
+func (a *udpAssociation) run() error {
+	c := a.c
+	var buf [maxUDPPayload]byte
+	var fragments *reassembler
+	if !c.h.config.DropUDPFragments {
+		fragments = newReassembler(c.h.config.UDPReassemblyTimeout, maxUDPPayload)
+	}
+	controlIP := utils.IPFromAddr(c.conn.RemoteAddr())
+	// readDeadline is the reassembly deadline of the fragments being queued (zero if none),
+	// so a sequence that stops arriving is dropped by its timer and not by the next fragment.
+	var readDeadline time.Time
+
+	for {
+		if fragments != nil {
+			if deadline := fragments.timerDeadline(); !deadline.Equal(readDeadline) {
+				readDeadline = deadline
+				a.relayConn.SetReadDeadline(readDeadline)
+			}
+		}
+		n, senderAddr, err := a.relayConn.ReadFromUDP(buf[:])
+		if err != nil {
+			if a.isClosed() {
+				// idle, the control connection is closed or the server is closing
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && fragments != nil {
+				if fragments.expire(time.Now()) {
+					c.h.config.Metrics.UDPDropped("reassembly_timeout")
+					c.log.Debug("udp fragment dropped", "reason", "reassembly_timeout")
+				}
+				continue
+			}
+			return err
+		}
+
+		// the client is the sender of the first datagram coming from the IP of the control connection
+		if a.clientAddr == nil {
+			if !sameIP(senderAddr.IP, controlIP) {
+				c.h.config.Metrics.UDPDropped("unknown_sender")
+				continue
+			}
+			a.clientAddr = senderAddr
+		} else if !sameIP(senderAddr.IP, a.clientAddr.IP) {
+			c.h.config.Metrics.UDPDropped("unknown_sender")
+			continue
+		}
+		a.idle.Touch()
+
+		req, err := parseUDPAssociateRequest(buf[:n])
+		if err != nil {
+			c.h.config.Metrics.UDPDropped("malformed")
+			c.log.Debug("udp datagram dropped", "reason", err)
+			continue
+		}
+		payload := buf[req.payloadIndex:n]
+		if req.fragmentNumber != 0 {
+			if fragments == nil {
+				c.h.config.Metrics.UDPDropped("fragmented")
+				continue
+			}
+			var dropped string
+			req, payload, dropped = fragments.add(req, buf[:n], time.Now())
+			if dropped != "" {
+				c.h.config.Metrics.UDPDropped(dropped)
+				c.log.Debug("udp fragment dropped", "reason", dropped)
+			}
+			if req == nil {
+				// the sequence is not complete yet
+				continue
+			}
+		}
+		if err := a.resolve(req); err != nil {
+			c.h.config.Metrics.UDPDropped("resolve_failed")
+			c.log.Debug("udp datagram dropped", "dest", req.destHost, "reason", err)
+			continue
+		}
+		allowed, rule := c.h.config.Rules.Decide(c.udpRulesRequest(req))
+		if !allowed {
+			c.h.config.Metrics.UDPDropped("not_allowed")
+			c.log.Debug("udp datagram dropped", "dest", req.destAddr, "reason", "not allowed")
+			continue
+		}
+		if err := c.h.config.Egress.Check(req.destAddr.IP); err != nil {
+			c.h.config.Metrics.UDPDropped("egress_blocked")
+			c.log.Debug("udp datagram dropped", "dest", req.destAddr, "reason", err)
+			continue
+		}
+		if a.limits != nil && !a.limits.AllowUp(len(payload), ruleNameOf(rule)) {
+			c.h.config.Metrics.UDPDropped("rate_limited")
+			continue
+		}
+		out, err := a.outboundFor(req.destAddr.IP)
+		if err == nil {
+			_, err = out.WriteTo(payload, req.destAddr)
+		}
+		if err != nil {
+			c.h.config.Metrics.UDPDropped("send_failed")
+			c.log.Debug("udp datagram dropped", "dest", req.destAddr, "reason", err)
+			continue
+		}
+		c.h.config.Metrics.UDPRelayed("up")
+		c.sess.AddBytes(int64(len(payload)), 0)
+	}
+}
+
+// resolve sets the destination address of a request to a domain name to its first address the IP policy allows,
+// the answer is reused by the next datagrams to the same name for udpResolveTTL.
+func (a *udpAssociation) resolve(req *udpAssociateRequest) error {
+	if req.destAddr != nil {
+		return nil
+	}
+	name := strings.ToLower(req.destHost)
+	now := time.Now()
+	entry, ok := a.resolved[name]
+	if !ok || now.After(entry.expires) {
+		ips, err := utils.ResolveIPs(a.ctx, a.c.h.config.Resolv, a.c.h.config.IPPolicy, req.destHost)
+		if err != nil {
+			return err
+		}
+		if len(a.resolved) >= maxUDPResolved {
+			for name, entry := range a.resolved {
+				if now.After(entry.expires) {
+					delete(a.resolved, name)
+				}
+			}
+			if len(a.resolved) >= maxUDPResolved {
+				a.resolved = make(map[string]resolvedIP)
+			}
+		}
+		entry = resolvedIP{ip: ips[0], expires: now.Add(udpResolveTTL)}
+		a.resolved[name] = entry
+	}
+	req.destAddr = &net.UDPAddr{IP: entry.ip, Port: int(req.destPort)}
+	return nil
+}
+
+// outboundFor returns the socket sending to ip, the socket of each family is opened on first use
+// along with the relay of the datagrams it receives back to the client.
+func (a *udpAssociation) outboundFor(ip net.IP) (net.PacketConn, error) {
+	network := "udp6"
+	if ip.To4() != nil {
+		network = "udp4"
+	}
+	if conn, ok := a.outbound[network]; ok {
+		return conn, nil
+	}
+	conn, err := a.c.h.config.ListenPacket(a.ctx, network, "")
+	if err != nil {
+		return nil, err
+	}
+	a.outbound[network] = conn
+	a.replies.Add(1)
+	go a.relayReplies(conn)
+	return conn, nil
+}
+
+// relayReplies sends the datagrams received on conn to the client until conn is closed.
+func (a *udpAssociation) relayReplies(conn net.PacketConn) {
+	defer a.replies.Done()
+	c := a.c
+	var buf [maxUDPPayload]byte
+	for {
+		n, from, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		senderAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			c.h.config.Metrics.UDPDropped("unknown_sender")
+			continue
+		}
+		a.idle.Touch()
+		if a.limits != nil && !a.limits.AllowDown(n, c.udpReplyRuleName(senderAddr)) {
+			c.h.config.Metrics.UDPDropped("rate_limited")
+			continue
+		}
+		_, err = a.relayConn.WriteToUDP(udpAssociateReply(senderAddr, buf[:n]), a.clientAddr)
+		if err != nil {
+			if a.isClosed() {
+				return
+			}
+			c.h.config.Metrics.UDPDropped("send_failed")
+			continue
+		}
+		c.h.config.Metrics.UDPRelayed("down")
+		atomic.AddInt64(&a.down, int64(n))
+	}
+}
+
+// sameIP compares a and b treating an IPv4-mapped IPv6 address (::ffff:a.b.c.d) as the IPv4 address it maps,
+// a dual-stack listener reports IPv4 clients in that form.
+func sameIP(a, b net.IP) bool {
+	if a4 := a.To4(); a4 != nil {
+		a = a4
+	}
+	if b4 := b.To4(); b4 != nil {
+		b = b4
+	}
+	return a.Equal(b)
+}
+
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+type udpAssociateRequest struct {
+	fragmentNumber byte
+	addressType    addrType
+	destHost       string
+	destPort       uint16
+	// destAddr is nil until a domain name destination is resolved.
+	destAddr     *net.UDPAddr
+	payloadIndex int
+}
+
+func parseUDPAssociateRequest(b []byte) (*udpAssociateRequest, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("udp associate request is too short -> (%d bytes) <-", len(b))
+	}
+	fragmentNumber := b[2]
+	addressType := addrType(b[3])
+	var payloadIndex int
+	switch addressType {
+	case ipv4:
+		payloadIndex = 4 + net.IPv4len + 2
+	case domainname:
+		payloadIndex = 5 + int(b[4]) + 2
+	case ipv6:
+		payloadIndex = 4 + net.IPv6len + 2
+	default:
+		return nil, fmt.Errorf("invalid address type code -> (%v) <-", addressType)
+	}
+	if len(b) < payloadIndex {
+		return nil, fmt.Errorf("udp associate request is too short -> (%d bytes) <-", len(b))
+	}
+	portIndex := payloadIndex - 2
+	var host string
+	if addressType == domainname {
+		host = string(b[5:portIndex])
+	} else {
+		host = net.IP(b[4:portIndex]).String()
+	}
+	port := binary.BigEndian.Uint16(b[portIndex : portIndex+2])
+	req := &udpAssociateRequest{fragmentNumber: fragmentNumber, addressType: addressType, destHost: host, destPort: port, payloadIndex: payloadIndex}
+	// domain names are resolved (by the association) only once the datagram is complete
+	if ip := net.ParseIP(host); ip != nil {
+		req.destAddr = &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	return req, nil
+}
+
+func (c *client) udpRulesRequest(req *udpAssociateRequest) *rules.Request {
+	r := &rules.Request{
+		ClientIP: utils.IPFromAddr(c.conn.RemoteAddr()),
+		User:     c.identity.Username,
+		Command:  rules.UDPAssociate,
+		DestIP:   req.destAddr.IP,
+		DestPort: uint16(req.destAddr.Port),
+	}
+	if req.addressType == domainname {
+		r.DestHost = req.destHost
+	}
+	return r
+}
+
+// udpReplyRuleName returns the name of the rule matching a datagram coming from addr (as if it was sent to it).
+func (c *client) udpReplyRuleName(addr *net.UDPAddr) string {
+	return ruleNameOf(c.h.config.Rules.Match(&rules.Request{
+		ClientIP: utils.IPFromAddr(c.conn.RemoteAddr()),
+		User:     c.identity.Username,
+		Command:  rules.UDPAssociate,
+		DestIP:   addr.IP,
+		DestPort: uint16(addr.Port),
+	}))
+}
+
+// udpAssociateReply encapsulates a datagram coming from addr, an IPv4 (or IPv4-mapped) address is sent as ipv4.
+func udpAssociateReply(addr *net.UDPAddr, payload []byte) []byte {
+	addressType := ipv4
+	ip := addr.IP.To4()
+	if ip == nil {
+		addressType = ipv6
+		ip = addr.IP.To16()
+	}
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+	packet := make([]byte, 0, 4+len(ip)+2+len(payload))
+	packet = append(packet, 0, 0, 0, byte(addressType))
+	packet = append(packet, ip...)
+	packet = append(packet, port[:]...)
+	packet = append(packet, payload...)
+	return packet
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// Session describes a client connection from accept to close, it is filled by the goroutine
+// serving the connection (the handlers) and read once the connection is done.
+type Session struct {
+	ID         string
+	ClientAddr string
+	Start      time.Time
+	End        time.Time
+	// Version is "4", "5" or "http" (empty until the protocol is sniffed).
+	Version    string
+	Command    string
+	AuthMethod string
+	User       string
+	// RequestedDest is the destination as requested by the client (host:port, the host may be a domain name).
+	RequestedDest string
+	// ResolvedDest is the destination IP and port the request resolved to (empty if it was never resolved locally).
+	ResolvedDest string
+	// ReplyCode is the last reply code sent to the client (the socks reply code or the HTTP status code), -1 if none was sent.
+	ReplyCode int
+	BytesUp   int64
+	BytesDown int64
+	Err       error
+}
+
+// New returns a session started now for the client at clientAddr with a random ID.
+func New(clientAddr net.Addr) *Session {
+	s := &Session{ID: newID(), Start: time.Now(), ReplyCode: -1}
+	if clientAddr != nil {
+		s.ClientAddr = clientAddr.String()
+	}
+	return s
+}
+
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// AddBytes adds to the bytes relayed in each direction, up is client to destination.
+func (s *Session) AddBytes(up, down int64) {
+	s.BytesUp += up
+	s.BytesDown += down
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying s.
+func NewContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the session carried by ctx, a detached session is returned if there is none
+// (such as a handler used directly without a SocksServer) so callers never check for nil.
+func FromContext(ctx context.Context) *Session {
+	if s, ok := ctx.Value(contextKey{}).(*Session); ok {
+		return s
+	}
+	return New(nil)
+}
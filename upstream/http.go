@@ -0,0 +1,92 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/OmarTariq612/socks-server/utils"
+)
+
+type httpConnect struct {
+	addr    string
+	auth    string
+	forward DialFunc
+}
+
+func newHTTPConnect(u *url.URL, forward DialFunc) *httpConnect {
+	h := &httpConnect{addr: proxyAddr(u, "80"), forward: forward}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		h.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+	return h
+}
+
+func (h *httpConnect) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	conn, err := h.forward(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	var tunnel net.Conn
+	err = handshake(ctx, conn, func() error {
+		var err error
+		tunnel, err = h.connect(conn, addr)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http upstream (%s): %w", h.addr, err)
+	}
+	return tunnel, nil
+}
+
+func (h *httpConnect) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.auth != "" {
+		req.Header.Set("Proxy-Authorization", h.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CONNECT response")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT failed -> (%s) <-", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps bytes the proxy sent right after the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
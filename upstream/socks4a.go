@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socks4Version byte = 4
+	socks4Connect byte = 1
+
+	socks4RequestGranted byte = 90
+)
+
+type socks4a struct {
+	addr    string
+	userID  string
+	forward DialFunc
+}
+
+func newSocks4a(u *url.URL, forward DialFunc) *socks4a {
+	s := &socks4a{addr: proxyAddr(u, "1080"), forward: forward}
+	if u.User != nil {
+		s.userID = u.User.Username()
+	}
+	return s
+}
+
+func (s *socks4a) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	conn, err := s.forward(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := handshake(ctx, conn, func() error { return s.connect(conn, addr) }); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks4a upstream (%s): %w", s.addr, err)
+	}
+	return conn, nil
+}
+
+// +----+----+----+----+----+----+----+----+----+----+....+----+....+----+
+// | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL| HOST |NULL|
+// +----+----+----+----+----+----+----+----+----+----+....+----+....+----+
+func (s *socks4a) connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port -> (%s) <-", portStr)
+	}
+
+	req := make([]byte, 8, 10+len(s.userID)+len(host))
+	req[0] = socks4Version
+	req[1] = socks4Connect
+	binary.BigEndian.PutUint16(req[2:4], uint16(port))
+	var domain string
+	if ip := net.ParseIP(host); ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return fmt.Errorf("socks4a does not support IPv6 destinations -> (%s) <-", host)
+		}
+		copy(req[4:8], ip4)
+	} else {
+		// IP address 0.0.0.x tells the proxy to resolve the domain name
+		req[7] = 1
+		domain = host
+	}
+	req = append(req, s.userID...)
+	req = append(req, 0)
+	if domain != "" {
+		req = append(req, domain...)
+		req = append(req, 0)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var rep [8]byte
+	if _, err := io.ReadFull(conn, rep[:]); err != nil {
+		return fmt.Errorf("could not read reply")
+	}
+	if rep[1] != socks4RequestGranted {
+		return fmt.Errorf("request rejected or failed -> (%d) <-", rep[1])
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"syscall"
+)
+
+const (
+	socks5Version byte = 5
+
+	socks5NoAuth           byte = 0x00
+	socks5UsernamePassword byte = 0x02
+	socks5NoAcceptable     byte = 0xFF
+
+	socks5Connect byte = 1
+
+	socks5IPv4       byte = 1
+	socks5Domainname byte = 3
+	socks5IPv6       byte = 4
+)
+
+var socks5Errors = [...]string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+type socks5 struct {
+	addr     string
+	username string
+	password string
+	forward  DialFunc
+}
+
+func newSocks5(u *url.URL, forward DialFunc) *socks5 {
+	s := &socks5{addr: proxyAddr(u, "1080"), forward: forward}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	return s
+}
+
+func (s *socks5) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	conn, err := s.forward(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := handshake(ctx, conn, func() error { return s.connect(conn, addr) }); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 upstream (%s): %w", s.addr, err)
+	}
+	return conn, nil
+}
+
+func (s *socks5) connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port -> (%s) <-", portStr)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if s.username != "" {
+		methods = append(methods, socks5UsernamePassword)
+	}
+	buf := make([]byte, 0, 3+len(methods))
+	buf = append(buf, socks5Version, byte(len(methods)))
+	buf = append(buf, methods...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	var handshakeReply [2]byte
+	if _, err := io.ReadFull(conn, handshakeReply[:]); err != nil {
+		return fmt.Errorf("could not read handshake reply")
+	}
+	if handshakeReply[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version -> (%d) <-", handshakeReply[0])
+	}
+	switch handshakeReply[1] {
+	case socks5NoAuth:
+	case socks5UsernamePassword:
+		if err := s.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return errors.New("no acceptable auth method")
+	default:
+		return fmt.Errorf("unsupported auth method -> (%d) <-", handshakeReply[1])
+	}
+
+	// +----+-----+-------+------+----------+----------+
+	// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	// +----+-----+-------+------+----------+----------+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5IPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5IPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("domain name is too long -> (%s) <-", host)
+		}
+		req = append(req, socks5Domainname, byte(len(host)))
+		req = append(req, host...)
+	}
+	var portBuf [2]byte
+	binary.BigEndian.PutUint16(portBuf[:], uint16(port))
+	req = append(req, portBuf[:]...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("could not read reply header")
+	}
+	if rep := header[1]; rep != 0 {
+		if int(rep) >= len(socks5Errors) {
+			return fmt.Errorf("unknown reply code -> (%d) <-", rep)
+		}
+		// wrap the matching errno so the failure can be classified (and reported) by the local server
+		switch rep {
+		case 3:
+			return &replyError{msg: socks5Errors[rep], errno: syscall.ENETUNREACH}
+		case 4:
+			return &replyError{msg: socks5Errors[rep], errno: syscall.EHOSTUNREACH}
+		case 5:
+			return &replyError{msg: socks5Errors[rep], errno: syscall.ECONNREFUSED}
+		case 6:
+			return &replyError{msg: socks5Errors[rep], errno: syscall.ETIMEDOUT}
+		default:
+			return errors.New(socks5Errors[rep])
+		}
+	}
+	var addrLen int
+	switch header[3] {
+	case socks5IPv4:
+		addrLen = net.IPv4len
+	case socks5IPv6:
+		addrLen = net.IPv6len
+	case socks5Domainname:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return fmt.Errorf("could not read bind domain name length")
+		}
+		addrLen = int(length[0])
+	default:
+		return fmt.Errorf("invalid address type code -> (%d) <-", header[3])
+	}
+	// BND.ADDR and BND.PORT are not needed
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return fmt.Errorf("could not read bind address")
+	}
+	return nil
+}
+
+// authenticate performs username/password subnegotiation (rfc 1929).
+func (s *socks5) authenticate(conn net.Conn) error {
+	if len(s.username) > 255 || len(s.password) > 255 {
+		return errors.New("username or password is too long")
+	}
+	buf := make([]byte, 0, 3+len(s.username)+len(s.password))
+	buf = append(buf, 1, byte(len(s.username)))
+	buf = append(buf, s.username...)
+	buf = append(buf, byte(len(s.password)))
+	buf = append(buf, s.password...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return fmt.Errorf("could not read auth status")
+	}
+	if status[1] != 0 {
+		return errors.New("auth failed: username or password is incorrect")
+	}
+	return nil
+}
+
+// replyError is a failure reply of the upstream proxy that unwraps to the matching errno.
+type replyError struct {
+	msg   string
+	errno syscall.Errno
+}
+
+func (e *replyError) Error() string {
+	return e.msg
+}
+
+func (e *replyError) Unwrap() error {
+	return e.errno
+}
@@ -0,0 +1,94 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DialFunc has the same signature as utils.Config.Dial
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// FromURL returns a DialFunc that tunnels connections through the proxy described by u,
+// forward is used to reach the proxy itself.
+//
+// supported schemes:
+//   - socks5://[user:pass@]host[:port]
+//   - socks4a://[userid@]host[:port] (socks4:// is accepted as well)
+//   - http://[user:pass@]host[:port] (HTTP CONNECT)
+func FromURL(u *url.URL, forward DialFunc) (DialFunc, error) {
+	if forward == nil {
+		var d net.Dialer
+		forward = d.DialContext
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		return newSocks5(u, forward).dial, nil
+	case "socks4", "socks4a":
+		return newSocks4a(u, forward).dial, nil
+	case "http":
+		return newHTTPConnect(u, forward).dial, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme -> (%s) <-", u.Scheme)
+	}
+}
+
+// Chain returns a DialFunc that goes through every proxy in proxyURLs in order,
+// the first one is dialed using forward and every next one is reached through the previous hop.
+func Chain(forward DialFunc, proxyURLs ...string) (DialFunc, error) {
+	dial := forward
+	for _, rawURL := range proxyURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy url (%s): %v", rawURL, err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream proxy url (%s): missing host", rawURL)
+		}
+		dial, err = FromURL(u, dial)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dial, nil
+}
+
+// proxyAddr returns the host:port of the proxy adding defaultPort if the url has no port.
+func proxyAddr(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// handshake runs fn (the proxy negotiation) on conn while honoring ctx's deadline and cancellation.
+func handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fn()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		conn.Close()
+		<-errc
+		return ctx.Err()
+	}
+}
+
+func checkNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	default:
+		return fmt.Errorf("upstream proxy does not support network -> (%s) <-", network)
+	}
+}
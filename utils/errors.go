@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/OmarTariq612/socks-server/egress"
+)
+
+// ErrNotAllowed is returned (wrapped) when the rules deny a request.
+var ErrNotAllowed = errors.New("request is not allowed by the rules")
+
+// ErrorKind classifies why a request failed, every protocol maps it to its own reply code.
+type ErrorKind byte
+
+const (
+	KindGeneral ErrorKind = iota
+	KindNotAllowed
+	KindNetworkUnreachable
+	KindHostUnreachable
+	KindConnectionRefused
+	KindTimeout
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindNotAllowed:
+		return "not allowed"
+	case KindNetworkUnreachable:
+		return "network unreachable"
+	case KindHostUnreachable:
+		return "host unreachable"
+	case KindConnectionRefused:
+		return "connection refused"
+	case KindTimeout:
+		return "timeout"
+	default:
+		return "general failure"
+	}
+}
+
+// Label is the kind as a metrics label value (snake_case, such as "not_allowed").
+func (k ErrorKind) Label() string {
+	switch k {
+	case KindNotAllowed:
+		return "not_allowed"
+	case KindNetworkUnreachable:
+		return "network_unreachable"
+	case KindHostUnreachable:
+		return "host_unreachable"
+	case KindConnectionRefused:
+		return "connection_refused"
+	case KindTimeout:
+		return "timeout"
+	default:
+		return "general_failure"
+	}
+}
+
+// RequestError is the error returned by the handlers when a request fails,
+// use errors.As to get the classification of an error returned by HandleConnection.
+type RequestError struct {
+	// Op is the failed step ("resolve", "dial", "rules", "limit", "bind" or "accept").
+	Op   string
+	Kind ErrorKind
+	Err  error
+}
+
+// NewRequestError classifies err.
+func NewRequestError(op string, err error) *RequestError {
+	return &RequestError{Op: op, Kind: Classify(err), Err: err}
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %v (%v)", e.Op, e.Err, e.Kind)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Classify returns the kind of a dial or resolve error (KindGeneral if it is not recognized).
+func Classify(err error) ErrorKind {
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.Kind
+	}
+	if errors.Is(err, ErrNotAllowed) || errors.Is(err, egress.ErrBlocked) {
+		return KindNotAllowed
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return KindTimeout
+		}
+		// NXDOMAIN, no records or a failing dns server
+		return KindHostUnreachable
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return KindConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return KindNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return KindHostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, context.DeadlineExceeded):
+		return KindTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return KindTimeout
+	}
+	return KindGeneral
+}
+
+// ResultLabel is the metrics label of the result of a dial or resolution, "ok" for a nil error or the label of the error kind otherwise.
+func ResultLabel(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return Classify(err).Label()
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultAttemptDelay is the Connection Attempt Delay recommended by rfc 8305.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// IPPolicy selects which addresses of a resolved domain name are used and in what order.
+type IPPolicy int
+
+const (
+	// DualStack uses both families, alternating them starting with the family of the first address the resolver returned (rfc 8305 section 4),
+	// the resolvers of the resolver package return IPv6 first and the system one sorts its addresses as rfc 6724 does.
+	DualStack IPPolicy = iota
+	IPv4Only
+	IPv6Only
+)
+
+func ParseIPPolicy(s string) (IPPolicy, error) {
+	switch s {
+	case "dual":
+		return DualStack, nil
+	case "ipv4":
+		return IPv4Only, nil
+	case "ipv6":
+		return IPv6Only, nil
+	default:
+		return DualStack, fmt.Errorf("invalid ip policy -> (%s) <-, expected 'dual', 'ipv4' or 'ipv6'", s)
+	}
+}
+
+func (p IPPolicy) String() string {
+	switch p {
+	case IPv4Only:
+		return "ipv4"
+	case IPv6Only:
+		return "ipv6"
+	default:
+		return "dual"
+	}
+}
+
+// Sort returns (in a new slice) the addresses of ips that p allows in the order they should be tried.
+func (p IPPolicy) Sort(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch p {
+	case IPv4Only:
+		return v4
+	case IPv6Only:
+		return v6
+	}
+	first, second := v4, v6
+	if len(ips) > 0 && ips[0].To4() == nil {
+		first, second = v6, v4
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// ResolveIPs resolves name using r and returns the addresses policy allows in the order they should be tried,
+// a name without any such address is reported as not found.
+func ResolveIPs(ctx context.Context, r Resolver, policy IPPolicy, name string) ([]net.IP, error) {
+	ips, err := r.Resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips = policy.Sort(ips)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: fmt.Sprintf("no %s address", policy), Name: name, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// DialHappyEyeballs connects to one of ips (on port) as rfc 8305 describes: the addresses are dialed in order,
+// a new attempt starting every attemptDelay or as soon as the previous one fails, the first connection established
+// wins and the others are cancelled. it returns the connection and the address it was dialed with, or the error of the first attempt.
+func DialHappyEyeballs(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, ips []net.IP, port string, attemptDelay time.Duration) (net.Conn, string, error) {
+	if len(ips) == 0 {
+		return nil, "", errors.New("no address to dial")
+	}
+	if len(ips) == 1 {
+		addr := net.JoinHostPort(ips[0].String(), port)
+		conn, err := dial(ctx, network, addr)
+		return conn, addr, err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx = context.WithValue(ctx, happyEyeballsParentKey{}, parent)
+	type result struct {
+		conn net.Conn
+		addr string
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn: conn, addr: addr, err: err}
+		}()
+	}
+
+	start()
+	// the attempt timer restarts whenever an attempt starts
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	restartTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next < len(ips) {
+			timer.Reset(attemptDelay)
+		}
+	}
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// attempts still running are cancelled, any of them connecting anyway is closed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.addr, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+				restartTimer()
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				restartTimer()
+			}
+		}
+	}
+	return nil, "", firstErr
+}
+
+// happyEyeballsParentKey carries the context DialHappyEyeballs was called with in the context of its attempts.
+type happyEyeballsParentKey struct{}
+
+// LostHappyEyeballsRace reports whether the dial with ctx failed with err only because DialHappyEyeballs cancelled it
+// (another attempt connected first) while the dial as a whole is still running.
+func LostHappyEyeballsRace(ctx context.Context, err error) bool {
+	parent, ok := ctx.Value(happyEyeballsParentKey{}).(context.Context)
+	if !ok || err == nil || parent.Err() != nil {
+		return false
+	}
+	// the net package does not always wrap context.Canceled in the errors of cancelled dials
+	return errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled)
+}
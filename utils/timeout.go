@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialWithTimeout bounds every call of dial (including any proxy handshake) to timeout, zero means no bound.
+func DialWithTimeout(dial func(ctx context.Context, network, addr string) (net.Conn, error), timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
+
+// IdleTimer calls onIdle once when no activity is reported (using Touch or the wrapped readers) for the idle duration.
+type IdleTimer struct {
+	idle         time.Duration
+	lastActivity int64 // unix nano
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool // by Stop or once onIdle is called
+}
+
+// NewIdleTimer starts the timer, a zero (or negative) idle duration disables it.
+func NewIdleTimer(idle time.Duration, onIdle func()) *IdleTimer {
+	t := &IdleTimer{idle: idle, lastActivity: time.Now().UnixNano()}
+	if idle <= 0 {
+		return t
+	}
+	check := func() {
+		t.mu.Lock()
+		if t.stopped {
+			t.mu.Unlock()
+			return
+		}
+		elapsed := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+		if elapsed < t.idle {
+			t.timer.Reset(t.idle - elapsed)
+			t.mu.Unlock()
+			return
+		}
+		t.stopped = true
+		t.mu.Unlock()
+		onIdle()
+	}
+	// check can not run before the timer is set as it takes the lock first
+	t.mu.Lock()
+	t.timer = time.AfterFunc(idle, check)
+	t.mu.Unlock()
+	return t
+}
+
+// Touch reports activity.
+func (t *IdleTimer) Touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+// Reader returns a reader reporting activity whenever r returns data.
+func (t *IdleTimer) Reader(r io.Reader) io.Reader {
+	if t.idle <= 0 {
+		return r
+	}
+	return &idleReader{r: r, t: t}
+}
+
+// Stop stops the timer, onIdle is not called afterwards (unless it is already running).
+func (t *IdleTimer) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+type idleReader struct {
+	r io.Reader
+	t *IdleTimer
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.t.Touch()
+	}
+	return n, err
+}
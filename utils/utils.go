@@ -2,29 +2,127 @@ package utils
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
+	"strings"
 	"time"
+
+	"github.com/OmarTariq612/socks-server/accesslog"
+	"github.com/OmarTariq612/socks-server/connlimit"
+	"github.com/OmarTariq612/socks-server/egress"
+	"github.com/OmarTariq612/socks-server/logging"
+	"github.com/OmarTariq612/socks-server/metrics"
+	"github.com/OmarTariq612/socks-server/ratelimit"
+	"github.com/OmarTariq612/socks-server/rules"
 )
 
+// Config is shared by the protocol handlers, the ctx passed to Resolv and Dial
+// carries the identity of the authenticated client (see auth.FromContext).
 type Config struct {
 	Resolv Resolver
 	Dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	// ListenPacket opens the sockets UDP associations send datagrams through (one per network, udp4 or udp6),
+	// it is the packet equivalent of Dial to redirect or chain UDP egress (ReadFrom must report *net.UDPAddr sources).
+	ListenPacket func(ctx context.Context, network, addr string) (net.PacketConn, error)
+	// BindTimeout is how long a BIND request waits for the incoming connection.
+	BindTimeout time.Duration
+	// HandshakeTimeout bounds the time from accepting a connection until its request is read (handshake and auth included).
+	HandshakeTimeout time.Duration
+	// DialTimeout bounds every call of Dial.
+	DialTimeout time.Duration
+	// IdleTimeout closes a relayed connection with no traffic in either direction for this long (zero disables it).
+	IdleTimeout time.Duration
+	// MaxLifetime closes a session this long after it was accepted whatever its activity is (zero disables it).
+	MaxLifetime time.Duration
+	// UDPIdleTimeout ends a UDP association that relays no datagram for this long (zero disables it).
+	UDPIdleTimeout time.Duration
+	// DropUDPFragments drops the fragmented datagrams (FRAG other than 0) of socks5 UDP associations instead of reassembling them.
+	DropUDPFragments bool
+	// UDPReassemblyTimeout is how long the fragments of a datagram are kept waiting for the rest of them (at least 5s, the default).
+	UDPReassemblyTimeout time.Duration
+	// Rules decides which requests are allowed (nil allows everything).
+	Rules *rules.RuleSet
+	// Egress blocks destination IPs right before dialing and for every UDP datagram (nil blocks nothing).
+	Egress *egress.Guard
+	// RemoteDNS reports whether the domain name host of a CONNECT request should be
+	// passed to Dial unresolved (nil means every domain name is resolved locally first).
+	RemoteDNS func(host string) bool
+	// IPPolicy selects the addresses of resolved domain names that are used (both families by default).
+	IPPolicy IPPolicy
+	// AttemptDelay is how long a CONNECT waits for an address of its destination before trying the next one
+	// in parallel (rfc 8305 Happy Eyeballs, DefaultAttemptDelay if zero).
+	AttemptDelay time.Duration
+	// Metrics records the server metrics (nil records nothing).
+	Metrics *metrics.Metrics
+	// AccessLog receives a record of every finished session (nil logs nothing).
+	AccessLog *accesslog.Logger
+	// SessionLimit caps the concurrent connections and sessions (nil is unlimited).
+	SessionLimit *connlimit.Limiter
+	// RateLimit limits the bandwidth of the sessions (nil is unlimited).
+	RateLimit *ratelimit.Limiter
+	// Logger receives the server and handler logs, records of a session carry its ID (nil uses the standard logger).
+	Logger logging.Logger
+}
+
+// RemoteDNSAll passes every domain name to the dialer unresolved.
+func RemoteDNSAll(string) bool {
+	return true
+}
+
+// RemoteDNSSuffixes passes a domain name unresolved only if it equals or is a subdomain of one of the suffixes.
+func RemoteDNSSuffixes(suffixes ...string) func(host string) bool {
+	normalized := make([]string, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.Trim(strings.TrimSpace(suffix), "."))
+		if suffix != "" {
+			normalized = append(normalized, suffix)
+		}
+	}
+	return func(host string) bool {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		for _, suffix := range normalized {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ResolvingDial returns a dial function that resolves domain names using r before dialing with dial
+// the addresses policy allows (racing them as DialHappyEyeballs does), addresses that are already IPs are passed as is.
+func ResolvingDial(r Resolver, policy IPPolicy, attemptDelay time.Duration, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		ips, err := ResolveIPs(ctx, r, policy, host)
+		if err != nil {
+			return nil, err
+		}
+		conn, _, err := DialHappyEyeballs(ctx, dial, network, ips, port, attemptDelay)
+		return conn, err
+	}
 }
 
 type Resolver interface {
-	Resolve(ctx context.Context, name string) (net.IP, error)
+	// Resolve returns the addresses of name (at least one unless err is set), the slice may be shared so it must not be modified.
+	Resolve(ctx context.Context, name string) ([]net.IP, error)
 }
 
 type DefaultResolver struct{}
 
-func (r DefaultResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
-	if err != nil {
-		return nil, err
-	}
-	return addr.IP, nil
+func (r DefaultResolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", name)
 }
 
+// CustomResolver resolves names with the dns server at dnsAddr (ip:port) using the go resolver,
+// every address of both families is returned (see resolver.NewDNS for one that knows the TTLs of the answers).
 type CustomResolver struct {
 	netResolver *net.Resolver
 }
@@ -40,10 +138,48 @@ func NewCustomResolver(dnsAddr string) *CustomResolver {
 	}
 }
 
-func (d *CustomResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
-	ips, err := d.netResolver.LookupIP(ctx, "ip", name)
-	if err != nil {
-		return nil, err
+func (d *CustomResolver) Resolve(ctx context.Context, name string) ([]net.IP, error) {
+	return d.netResolver.LookupIP(ctx, "ip", name)
+}
+
+// IPFromAddr returns the IP of a TCP or UDP address (nil for other addresses).
+func IPFromAddr(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+// CloseOnDone closes c when ctx is done (unless stop is called first).
+func CloseOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// CloseWrite shuts down the writing side of conn if it supports it (such as *net.TCPConn),
+// wrappers of connections use it to keep half-close working, or expose the connection they wrap with NetConn.
+func CloseWrite(conn net.Conn) error {
+	for {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			return cw.CloseWrite()
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return errors.New("connection does not support closing its write side")
+		}
+		conn = wrapper.NetConn()
 	}
-	return ips[0], nil
 }